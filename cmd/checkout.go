@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewCheckoutCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "checkout <hash> <dest> | checkout --manifest <manifest> <destroot>",
+		Short: "Recreate paths from the objects in storage",
+		Args:  cobra.RangeArgs(1, 2),
+		Run:   checkoutCommand,
+	}
+
+	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
+	cmd.Flags().String("manifest", "", "Recreate the paths of the given manifest under the destination root")
+	cmd.Flags().Bool("copy", false, "Create independent copies instead of links to the storage")
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+
+	return cmd
+}
+
+func checkoutCommand(cmd *cobra.Command, args []string) {
+	storagePath, _ := cmd.Flags().GetString("storage")
+	if storagePath == "" {
+		storagePath = GetDefaultStoragePath()
+	}
+	manifestPath, _ := cmd.Flags().GetString("manifest")
+	copyFiles, _ := cmd.Flags().GetBool("copy")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	if manifestPath != "" && len(args) != 1 {
+		log.Fatal("With --manifest only the destination root is expected")
+	}
+	if manifestPath == "" && len(args) != 2 {
+		log.Fatal("A hash and a destination are expected")
+	}
+
+	// Open storage
+	s, err := storage.OpenStorage(storagePath)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+
+	if manifestPath == "" {
+		hash, dest := args[0], args[1]
+		log.Printf("Checking out %s to %s..", hash, dest)
+		if err := s.Checkout(hash, dest, copyFiles); err != nil {
+			log.Fatalf("Error checking out object: %v", err)
+		}
+		log.Print("Done")
+		return
+	}
+
+	// Load manifest
+	manifest, err := storage.LoadManifest(manifestPath)
+	if err != nil {
+		log.Fatalf("Error loading manifest: %v", err)
+	}
+
+	// Checkout
+	root := args[0]
+	log.Printf("Checking out %d paths to %s..", len(manifest), root)
+	report, err := s.CheckoutManifest(manifest, root, copyFiles)
+	if err != nil {
+		log.Fatalf("Error checking out manifest: %v", err)
+	}
+
+	if verbose {
+		for _, p := range report.CheckedOut {
+			fmt.Printf("- checked out: %s\n", p)
+		}
+		for _, p := range report.Skipped {
+			fmt.Printf("- already linked: %s\n", p)
+		}
+	}
+
+	log.Printf("Checked out %d paths, %d already linked", len(report.CheckedOut), len(report.Skipped))
+	log.Print("Done")
+}
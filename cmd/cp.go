@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
 	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
 	"github.com/mirkobrombin/dabadee/pkg/processor"
 	"github.com/mirkobrombin/dabadee/pkg/storage"
 	"github.com/spf13/cobra"
@@ -12,36 +18,132 @@ import (
 
 func NewCpCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "cp [source] [dest]",
-		Short: "Copy a file and deduplicate it in storage",
-		Args:  cobra.ExactArgs(2),
+		Use:   "cp [source...] [dest]",
+		Short: "Copy files or directories and deduplicate them in storage",
+		Args:  cobra.MinimumNArgs(2),
 		Run:   cpCommand,
 	}
 
 	cmd.Flags().BoolP("with-metadata", "m", false, "Include file metadata in hash calculation")
 	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.Flags().String("link-mode", string(storage.LinkHardlink), "How files are linked to the storage: hardlink, reflink, auto or symlink")
+	cmd.Flags().Bool("relative-symlinks", false, "Use relative symlinks with the symlink link mode")
+	cmd.Flags().String("layout", "flat", "Fan-out layout of a new storage, like 2x2 for 2 levels of 2 hash characters")
 	cmd.Flags().BoolP("append", "a", false, "Append directory contents to destination")
 	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
+	cmd.Flags().String("on-conflict", "", "What to do with the paths already in the destination: overwrite, no-clobber, update-if-newer, backup or fail (default overwrite, no-clobber with --append)")
+	cmd.Flags().String("backup-suffix", processor.DefaultBackupSuffix, "Suffix of the paths moved aside with --on-conflict backup")
 	cmd.Flags().Int("workers", 1, "Number of workers to use")
+	cmd.Flags().StringArray("exclude", nil, "Skip the paths matching the given gitignore-style pattern")
+	cmd.Flags().StringArray("include", nil, "Process the paths matching the given gitignore-style pattern even if excluded")
+	cmd.Flags().Bool("no-ignore-files", false, "Do not read the "+ignore.FileName+" files found in the source")
+	cmd.Flags().String("min-size", "", "Skip files smaller than the given size, like 4K or 1M")
+	cmd.Flags().String("max-size", "", "Skip files larger than the given size, like 4K or 1M")
+	cmd.Flags().String("older-than", "", "Skip files modified within the given time, like 12h or 7d")
+	cmd.Flags().StringSlice("type", nil, "Only process files of the given types: regular, no-setuid, no-exec")
+	cmd.Flags().BoolP("one-file-system", "x", false, "Do not descend into directories on other filesystems")
+	cmd.Flags().Bool("fail-fast", false, "Stop at the first file that cannot be processed")
+	cmd.Flags().String("errors-output", "", "Write the files that could not be processed as JSON to the given path")
+	cmd.Flags().String("stats-json", "", "Write the statistics of the run as JSON to the given path, - for stdout")
+	cmd.Flags().Bool("no-progress", false, "Do not show the progress on the terminal")
+	cmd.Flags().Bool("dry-run", false, "Report what would be done without touching any file")
 
 	return cmd
 }
 
 func cpCommand(cmd *cobra.Command, args []string) {
-	source, dest := args[0], args[1]
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+	source, additionalSources := sources[0], sources[1:]
 	storagePath, _ := cmd.Flags().GetString("storage")
 	if storagePath == "" {
 		storagePath = GetDefaultStoragePath()
 	}
 	withMetadata, _ := cmd.Flags().GetBool("with-metadata")
 	verbose, _ := cmd.Flags().GetBool("verbose")
+	linkMode, _ := cmd.Flags().GetString("link-mode")
+	relativeSymlinks, _ := cmd.Flags().GetBool("relative-symlinks")
 	appendFlag, _ := cmd.Flags().GetBool("append")
 	workers, _ := cmd.Flags().GetInt("workers")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	noProgress, _ := cmd.Flags().GetBool("no-progress")
+	failFast, _ := cmd.Flags().GetBool("fail-fast")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	include, _ := cmd.Flags().GetStringArray("include")
+	noIgnoreFiles, _ := cmd.Flags().GetBool("no-ignore-files")
+	oneFileSystem, _ := cmd.Flags().GetBool("one-file-system")
+	fallback := processor.ConflictOverwrite
+	if appendFlag {
+		fallback = processor.ConflictNoClobber
+	}
+	conflicts, err := getConflicts(cmd, fallback)
+	if err != nil {
+		log.Fatalf("Error parsing conflict policy: %v", err)
+	}
+	filters, err := getFilters(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing filters: %v", err)
+	}
+	layout, err := getLayout(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %v", err)
+	}
+
+	// Hand the copy to the daemon if one is running
+	if client := daemonClient(cmd); client != nil {
+		var method string
+		var params interface{}
+		if appendFlag {
+			method = daemon.MethodDedup
+			params, err = getDedupParams(cmd, sources, dest, storagePath)
+			if err != nil {
+				log.Fatalf("Error parsing filters: %v", err)
+			}
+		} else {
+			walkParams, err := getWalkParams(cmd)
+			if err != nil {
+				log.Fatalf("Error parsing filters: %v", err)
+			}
+			conflictParams, err := getConflictParams(cmd, fallback)
+			if err != nil {
+				log.Fatalf("Error parsing conflict policy: %v", err)
+			}
+			method = daemon.MethodCp
+			params = daemon.CpParams{
+				WalkParams:        walkParams,
+				ConflictParams:    conflictParams,
+				Storage:           getStorageParams(cmd, storagePath),
+				Source:            absPath(source),
+				AdditionalSources: absPaths(additionalSources),
+				Dest:              absPath(dest),
+				Workers:           workers,
+				DryRun:            dryRun,
+			}
+		}
+
+		ctx, stop := newSignalContext()
+		defer stop()
+
+		log.Printf("Copying %s to %s with the daemon..", strings.Join(sources, ", "), dest)
+		var result daemon.RunResult
+		err = client.Call(ctx, method, params, &result)
+		if errors.Is(err, context.Canceled) || result.Interrupted {
+			exitInterrupted()
+		}
+		if err != nil {
+			log.Fatalf("Error during copy and link: %v", err)
+		}
+
+		finishCp(cmd, result)
+		return
+	}
 
 	// Create storage
 	storageOpts := storage.StorageOptions{
-		Root:         storagePath,
-		WithMetadata: withMetadata,
+		Root:             storagePath,
+		WithMetadata:     withMetadata,
+		LinkMode:         storage.LinkMode(linkMode),
+		RelativeSymlinks: relativeSymlinks,
+		Layout:           layout,
 	}
 	s, err := storage.NewStorage(storageOpts)
 	if err != nil {
@@ -53,18 +155,87 @@ func cpCommand(cmd *cobra.Command, args []string) {
 
 	// Create processor based on the append flag
 	var proc processor.Processor
+	var report *processor.DryRunReport
+	var events *processor.Events
+	var stats *processor.DedupStats
 	if appendFlag {
-		proc = processor.NewDedupProcessor(source, dest, s, h, workers)
+		dedupProc := processor.NewDedupProcessor(source, dest, s, h, workers)
+		dedupProc.AdditionalSources = additionalSources
+		dedupProc.DryRun = dryRun
+		dedupProc.Conflicts = conflicts
+		dedupProc.Exclude = exclude
+		dedupProc.Include = include
+		dedupProc.NoIgnoreFiles = noIgnoreFiles
+		dedupProc.Filters = filters
+		dedupProc.OneFileSystem = oneFileSystem
+		dedupProc.FailFast = failFast
+		report = &dedupProc.DryRunReport
+		events = &dedupProc.Events
+		stats = &dedupProc.Stats
+		proc = dedupProc
 	} else {
-		proc = processor.NewCpProcessor(source, dest, s, h)
+		cpProc := processor.NewCpProcessor(source, dest, s, h)
+		cpProc.AdditionalSources = additionalSources
+		cpProc.Workers = workers
+		cpProc.DryRun = dryRun
+		cpProc.Conflicts = conflicts
+		cpProc.Exclude = exclude
+		cpProc.Include = include
+		cpProc.NoIgnoreFiles = noIgnoreFiles
+		cpProc.Filters = filters
+		cpProc.OneFileSystem = oneFileSystem
+		cpProc.FailFast = failFast
+		report = &cpProc.DryRunReport
+		events = &cpProc.Events
+		stats = &cpProc.Stats
+		proc = cpProc
 	}
 
-	// Run the processor
-	log.Printf("Copying %s to %s..", source, dest)
+	// Run the processor, stopping on SIGINT or SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Printf("Copying %s to %s..", strings.Join(sources, ", "), dest)
 	d := dabadee.NewDaBaDee(proc, verbose)
-	if err := d.Run(); err != nil {
+	stopProgress := func() {}
+	if !verbose && !noProgress {
+		stopProgress = startProgress(events)
+	}
+	err = d.Run(ctx)
+	stopProgress()
+	if errors.Is(err, context.Canceled) {
+		exitInterrupted()
+	}
+	if err != nil && !isPartial(err) {
 		log.Fatalf("Error during copy and link: %v", err)
 	}
 
+	finishCp(cmd, daemon.RunResult{Stats: stats, DryRunReport: report})
+}
+
+// finishCp reports the result of a copy, done locally or by the daemon, and
+// writes the statistics
+func finishCp(cmd *cobra.Command, result daemon.RunResult) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	errorsOutput, _ := cmd.Flags().GetString("errors-output")
+	statsOutput, _ := cmd.Flags().GetString("stats-json")
+
+	reportConflicts(result.Stats, verbose)
+
+	if dryRun && result.DryRunReport != nil {
+		printDryRunReport(result.DryRunReport, verbose)
+	}
+
+	if statsOutput != "" {
+		writeStats(result.Stats, statsOutput)
+	}
+
+	if failures := result.Stats.Failures; len(failures) > 0 {
+		reportFailures(failures, errorsOutput)
+		log.Printf("Done, %d files could not be processed", len(failures))
+		os.Exit(exitStatusPartial)
+	}
+
 	log.Print("Done")
 }
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewDaemonCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep storages open and serve the other commands on a Unix socket",
+		Args:  cobra.NoArgs,
+		Run:   daemonCommand,
+	}
+
+	cmd.Flags().String("socket", daemon.DefaultSocketPath(), "Path of the Unix socket to listen on")
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+
+	cmd.AddCommand(newDaemonStatsCommand())
+
+	return cmd
+}
+
+func daemonCommand(cmd *cobra.Command, args []string) {
+	socket, _ := cmd.Flags().GetString("socket")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	// Create server
+	server := daemon.NewServer(socket, hash.NewSHA256Generator())
+	server.Verbose = verbose
+
+	// Serve until SIGINT or SIGTERM, the runs in progress are interrupted
+	// and their completed files recorded
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Printf("Listening on %s..", socket)
+	if err := server.Serve(ctx); err != nil {
+		log.Fatalf("Error running daemon: %v", err)
+	}
+
+	log.Print("Done")
+}
+
+func newDaemonStatsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show the storages kept open by the daemon",
+		Args:  cobra.NoArgs,
+		Run:   daemonStatsCommand,
+	}
+
+	cmd.Flags().String("socket", daemon.DefaultSocketPath(), "Path of the Unix socket of the daemon")
+	cmd.Flags().Bool("json", false, "Print the statistics as JSON")
+
+	return cmd
+}
+
+func daemonStatsCommand(cmd *cobra.Command, args []string) {
+	socket, _ := cmd.Flags().GetString("socket")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+
+	var stats daemon.StatsResult
+	err := daemon.NewClient(socket).Call(context.Background(), daemon.MethodStats, nil, &stats)
+	if err != nil {
+		log.Fatalf("Error getting daemon stats: %v", err)
+	}
+
+	if jsonOutput {
+		out, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			log.Fatalf("Error marshalling stats: %v", err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Printf("Up since %s, %d requests\n", stats.Started.Format(time.RFC3339), stats.Requests)
+	for _, st := range stats.Storages {
+		if st.Busy {
+			fmt.Printf("- %s: busy\n", st.Root)
+			continue
+		}
+		fmt.Printf("- %s: %d objects, %d cached files\n", st.Root, st.Objects, st.CacheEntries)
+	}
+}
+
+// daemonClient returns a client of the daemon if one is running, unless the
+// no-daemon flag is set, so that commands can hand their work to it
+func daemonClient(cmd *cobra.Command) *daemon.Client {
+	noDaemon, _ := cmd.Flags().GetBool("no-daemon")
+	if noDaemon {
+		return nil
+	}
+
+	socket := daemon.DefaultSocketPath()
+	if !daemon.Running(socket) {
+		return nil
+	}
+
+	return daemon.NewClient(socket)
+}
+
+// absPath returns the absolute form of the given path, the daemon does not
+// share the working directory of the commands
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatalf("Error resolving path %s: %v", path, err)
+	}
+	return abs
+}
+
+// absPaths returns the absolute form of the given paths
+func absPaths(paths []string) []string {
+	abs := make([]string, len(paths))
+	for i, path := range paths {
+		abs[i] = absPath(path)
+	}
+	return abs
+}
+
+// getStorageParams builds the storage params of a call to the daemon from
+// the with-metadata, link-mode, relative-symlinks and layout flags
+func getStorageParams(cmd *cobra.Command, storagePath string) daemon.StorageParams {
+	withMetadata, _ := cmd.Flags().GetBool("with-metadata")
+	linkMode, _ := cmd.Flags().GetString("link-mode")
+	relativeSymlinks, _ := cmd.Flags().GetBool("relative-symlinks")
+	// The commands check the layout beforehand
+	layout, _ := getLayout(cmd)
+
+	return daemon.StorageParams{
+		Root:             absPath(storagePath),
+		WithMetadata:     withMetadata,
+		LinkMode:         storage.LinkMode(linkMode),
+		RelativeSymlinks: relativeSymlinks,
+		Layout:           layout,
+	}
+}
+
+// getWalkParams builds the walk params of a call to the daemon from the
+// exclude, include, no-ignore-files, filter, one-file-system and fail-fast
+// flags
+func getWalkParams(cmd *cobra.Command) (daemon.WalkParams, error) {
+	var params daemon.WalkParams
+	params.Exclude, _ = cmd.Flags().GetStringArray("exclude")
+	params.Include, _ = cmd.Flags().GetStringArray("include")
+	params.NoIgnoreFiles, _ = cmd.Flags().GetBool("no-ignore-files")
+	params.Types, _ = cmd.Flags().GetStringSlice("type")
+	params.OneFileSystem, _ = cmd.Flags().GetBool("one-file-system")
+	params.FailFast, _ = cmd.Flags().GetBool("fail-fast")
+
+	var err error
+	if minSize, _ := cmd.Flags().GetString("min-size"); minSize != "" {
+		if params.MinSize, err = parseSize(minSize); err != nil {
+			return params, err
+		}
+	}
+	if maxSize, _ := cmd.Flags().GetString("max-size"); maxSize != "" {
+		if params.MaxSize, err = parseSize(maxSize); err != nil {
+			return params, err
+		}
+	}
+	if olderThan, _ := cmd.Flags().GetString("older-than"); olderThan != "" {
+		if params.OlderThan, err = parseAge(olderThan); err != nil {
+			return params, err
+		}
+	}
+
+	return params, nil
+}
+
+// getConflictParams builds the conflict params of a call to the daemon from
+// the on-conflict and backup-suffix flags
+func getConflictParams(cmd *cobra.Command, fallback processor.ConflictPolicy) (daemon.ConflictParams, error) {
+	conflicts, err := getConflicts(cmd, fallback)
+	if err != nil {
+		return daemon.ConflictParams{}, err
+	}
+
+	return daemon.ConflictParams{
+		OnConflict:   conflicts.OnConflict,
+		BackupSuffix: conflicts.BackupSuffix,
+	}, nil
+}
+
+// getDedupParams builds the params of a dedup call to the daemon from the
+// flags shared by dedup and cp
+func getDedupParams(cmd *cobra.Command, sources []string, destDir, storagePath string) (daemon.DedupParams, error) {
+	walkParams, err := getWalkParams(cmd)
+	if err != nil {
+		return daemon.DedupParams{}, err
+	}
+
+	conflictParams, err := getConflictParams(cmd, processor.ConflictNoClobber)
+	if err != nil {
+		return daemon.DedupParams{}, err
+	}
+
+	params := daemon.DedupParams{
+		WalkParams:        walkParams,
+		ConflictParams:    conflictParams,
+		Storage:           getStorageParams(cmd, storagePath),
+		Source:            absPath(sources[0]),
+		AdditionalSources: absPaths(sources[1:]),
+	}
+	if destDir != "" {
+		params.DestDir = absPath(destDir)
+	}
+	params.Workers, _ = cmd.Flags().GetInt("workers")
+	params.Paranoid, _ = cmd.Flags().GetBool("paranoid")
+	params.DryRun, _ = cmd.Flags().GetBool("dry-run")
+	manifestOutput, _ := cmd.Flags().GetString("manifest-output")
+	params.Manifest = manifestOutput != ""
+
+	return params, nil
+}
@@ -1,12 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
 	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
 	"github.com/mirkobrombin/dabadee/pkg/processor"
 	"github.com/mirkobrombin/dabadee/pkg/storage"
 	"github.com/spf13/cobra"
@@ -14,40 +19,123 @@ import (
 
 func NewDedupCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "dedup [source]",
-		Short: "Deduplicate files in a directory",
-		Args:  cobra.ExactArgs(1),
+		Use:   "dedup [source...]",
+		Short: "Deduplicate files in one or more directories",
+		Args:  cobra.MinimumNArgs(1),
 		Run:   dedupCommand,
 	}
 
 	cmd.Flags().BoolP("with-metadata", "m", false, "Include file metadata in hash calculation")
 	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.Flags().String("link-mode", string(storage.LinkHardlink), "How files are linked to the storage: hardlink, reflink, auto or symlink")
+	cmd.Flags().Bool("relative-symlinks", false, "Use relative symlinks with the symlink link mode")
+	cmd.Flags().String("layout", "flat", "Fan-out layout of a new storage, like 2x2 for 2 levels of 2 hash characters")
 	cmd.Flags().String("manifest-output", "", "Output manifest file to the given path")
+	cmd.Flags().Bool("manifest-metadata", false, "Include the metadata of each file in the manifest")
 	cmd.Flags().String("dest", "", "Destination directory for copying deduplicated files")
+	cmd.Flags().String("on-conflict", string(processor.ConflictNoClobber), "What to do with the paths already in the destination: overwrite, no-clobber, update-if-newer, backup or fail")
+	cmd.Flags().String("backup-suffix", processor.DefaultBackupSuffix, "Suffix of the paths moved aside with --on-conflict backup")
 	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
 	cmd.Flags().Int("workers", 1, "Number of workers to use")
+	cmd.Flags().Bool("paranoid", false, "Compare files byte by byte with the stored ones before linking")
+	cmd.Flags().StringArray("exclude", nil, "Skip the paths matching the given gitignore-style pattern")
+	cmd.Flags().StringArray("include", nil, "Process the paths matching the given gitignore-style pattern even if excluded")
+	cmd.Flags().Bool("no-ignore-files", false, "Do not read the "+ignore.FileName+" files found in the source")
+	cmd.Flags().String("min-size", "", "Skip files smaller than the given size, like 4K or 1M")
+	cmd.Flags().String("max-size", "", "Skip files larger than the given size, like 4K or 1M")
+	cmd.Flags().String("older-than", "", "Skip files modified within the given time, like 12h or 7d")
+	cmd.Flags().StringSlice("type", nil, "Only process files of the given types: regular, no-setuid, no-exec")
+	cmd.Flags().BoolP("one-file-system", "x", false, "Do not descend into directories on other filesystems")
+	cmd.Flags().Bool("fail-fast", false, "Stop at the first file that cannot be processed")
+	cmd.Flags().String("errors-output", "", "Write the files that could not be processed as JSON to the given path")
+	cmd.Flags().String("stats-json", "", "Write the statistics of the run as JSON to the given path, - for stdout")
+	cmd.Flags().Bool("no-progress", false, "Do not show the progress on the terminal")
+	cmd.Flags().Bool("dry-run", false, "Report what would be done without touching any file")
+	cmd.Flags().Bool("pool", false, "Use a storage per filesystem, kept in "+storage.DefaultPoolDir+" under its mount point")
 
 	return cmd
 }
 
 func dedupCommand(cmd *cobra.Command, args []string) {
-	source := args[0]
+	source, additionalSources := args[0], args[1:]
 	storagePath, _ := cmd.Flags().GetString("storage")
+	usePool, _ := cmd.Flags().GetBool("pool")
+	if usePool && storagePath != "" {
+		log.Fatal("The --storage and --pool flags cannot be used together")
+	}
 	if storagePath == "" {
 		storagePath = GetDefaultStoragePath()
 	}
 	withMetadata, _ := cmd.Flags().GetBool("with-metadata")
 	verbose, _ := cmd.Flags().GetBool("verbose")
+	linkMode, _ := cmd.Flags().GetString("link-mode")
+	relativeSymlinks, _ := cmd.Flags().GetBool("relative-symlinks")
 	outputManifest, _ := cmd.Flags().GetString("manifest-output")
 	destDir, _ := cmd.Flags().GetString("dest")
 	workers, _ := cmd.Flags().GetInt("workers")
+	paranoid, _ := cmd.Flags().GetBool("paranoid")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	noProgress, _ := cmd.Flags().GetBool("no-progress")
+	failFast, _ := cmd.Flags().GetBool("fail-fast")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	include, _ := cmd.Flags().GetStringArray("include")
+	noIgnoreFiles, _ := cmd.Flags().GetBool("no-ignore-files")
+	oneFileSystem, _ := cmd.Flags().GetBool("one-file-system")
+	conflicts, err := getConflicts(cmd, processor.ConflictNoClobber)
+	if err != nil {
+		log.Fatalf("Error parsing conflict policy: %v", err)
+	}
+	filters, err := getFilters(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing filters: %v", err)
+	}
+	layout, err := getLayout(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %v", err)
+	}
+
+	// Hand the run to the daemon if one is running, it keeps the storage
+	// and cache in memory between runs
+	if client := daemonClient(cmd); client != nil && !usePool {
+		params, err := getDedupParams(cmd, args, destDir, storagePath)
+		if err != nil {
+			log.Fatalf("Error parsing filters: %v", err)
+		}
+
+		ctx, stop := newSignalContext()
+		defer stop()
 
-	// Create storage
+		log.Printf("Deduplicating %s with the daemon..", strings.Join(args, ", "))
+		var result daemon.RunResult
+		err = client.Call(ctx, daemon.MethodDedup, params, &result)
+		if errors.Is(err, context.Canceled) {
+			exitInterrupted()
+		}
+		if err != nil {
+			log.Fatalf("Error during deduplication: %v", err)
+		}
+
+		finishDedup(cmd, result)
+		return
+	}
+
+	// Create storage, in pool mode the one of the source device is used
+	// for the cache while the others are picked per file
 	storageOpts := storage.StorageOptions{
-		Root:         storagePath,
-		WithMetadata: withMetadata,
+		Root:             storagePath,
+		WithMetadata:     withMetadata,
+		LinkMode:         storage.LinkMode(linkMode),
+		RelativeSymlinks: relativeSymlinks,
+		Layout:           layout,
+	}
+	var pool *storage.Pool
+	var s *storage.Storage
+	if usePool {
+		pool = storage.NewPool(storage.DefaultPoolDir, storageOpts)
+		s, err = pool.ForPath(source)
+	} else {
+		s, err = storage.NewStorage(storageOpts)
 	}
-	s, err := storage.NewStorage(storageOpts)
 	if err != nil {
 		log.Fatalf("Error creating storage: %v", err)
 	}
@@ -57,27 +145,118 @@ func dedupCommand(cmd *cobra.Command, args []string) {
 
 	// Create processor
 	processor := processor.NewDedupProcessor(source, destDir, s, h, workers)
+	processor.AdditionalSources = additionalSources
+	processor.Pool = pool
+	processor.Paranoid = paranoid
+	processor.DryRun = dryRun
+	processor.Conflicts = conflicts
+	processor.Exclude = exclude
+	processor.Include = include
+	processor.NoIgnoreFiles = noIgnoreFiles
+	processor.Filters = filters
+	processor.OneFileSystem = oneFileSystem
+	processor.FailFast = failFast
 
-	// Run the processor
-	log.Printf("Deduplicating %s..", source)
+	// Run the processor, on SIGINT or SIGTERM the completed files are still
+	// recorded so that running again resumes the work
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Printf("Deduplicating %s..", strings.Join(args, ", "))
 	d := dabadee.NewDaBaDee(processor, verbose)
-	if err := d.Run(); err != nil {
+	stopProgress := func() {}
+	if !verbose && !noProgress {
+		stopProgress = startProgress(&processor.Events)
+	}
+	err = d.Run(ctx)
+	stopProgress()
+	interrupted := errors.Is(err, context.Canceled)
+	if err != nil && !interrupted && !isPartial(err) {
 		log.Fatalf("Error during deduplication: %v", err)
 	}
 
+	result := daemon.RunResult{
+		Stats:        &processor.Stats,
+		DryRunReport: &processor.DryRunReport,
+		Interrupted:  interrupted,
+	}
+	if outputManifest != "" {
+		result.Manifest = processor.Manifest()
+	}
+	finishDedup(cmd, result)
+}
+
+// finishDedup reports the result of a dedup run, done locally or by the
+// daemon, and writes the manifest and statistics
+func finishDedup(cmd *cobra.Command, result daemon.RunResult) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	outputManifest, _ := cmd.Flags().GetString("manifest-output")
+	manifestMetadata, _ := cmd.Flags().GetBool("manifest-metadata")
+	errorsOutput, _ := cmd.Flags().GetString("errors-output")
+	statsOutput, _ := cmd.Flags().GetString("stats-json")
+	stats := result.Stats
+
+	if len(stats.Ignored) > 0 {
+		log.Printf("Ignored %d paths", len(stats.Ignored))
+	}
+	if stats.Filtered > 0 {
+		log.Printf("Filtered out %d files", stats.Filtered)
+	}
+	if stats.Special > 0 {
+		log.Printf("Skipped %d special files", stats.Special)
+	}
+	for _, path := range stats.Mounts {
+		log.Printf("Skipped mount point %s", path)
+	}
+
+	for _, path := range stats.Collisions {
+		log.Printf("Hash collision detected, stored separately: %s", path)
+	}
+
+	reportConflicts(stats, verbose)
+
+	if dryRun && result.DryRunReport != nil {
+		printDryRunReport(result.DryRunReport, verbose)
+	}
+
 	// Output manifest
 	if outputManifest != "" {
 		log.Printf("Writing manifest to %s..", outputManifest)
 
-		manifest, err := json.Marshal(processor.FileMap)
+		var manifest []byte
+		var err error
+		if manifestMetadata {
+			manifest, err = json.Marshal(result.Manifest)
+		} else {
+			fileMap := make(map[string]string, len(result.Manifest))
+			for path, entry := range result.Manifest {
+				fileMap[path] = entry.Hash
+			}
+			manifest, err = json.Marshal(fileMap)
+		}
 		if err != nil {
-			log.Fatalf("Error marshalling manifest: %v\n\nPrinting to stdout instead:\n\n%v", err, processor.FileMap)
+			log.Fatalf("Error marshalling manifest: %v\n\nPrinting to stdout instead:\n\n%v", err, result.Manifest)
 		}
 
 		if err := os.WriteFile(outputManifest, manifest, 0644); err != nil {
-			log.Fatalf("Error writing manifest: %v\n\nPrinting to stdout instead:\n\n%v", err, processor.FileMap)
+			log.Fatalf("Error writing manifest: %v\n\nPrinting to stdout instead:\n\n%v", err, result.Manifest)
 		}
 	}
 
+	if statsOutput != "" {
+		writeStats(stats, statsOutput)
+	}
+
+	if result.Interrupted {
+		exitInterrupted()
+	}
+
+	if len(stats.Failures) > 0 {
+		reportFailures(stats.Failures, errorsOutput)
+		log.Printf("Done, %d files could not be processed", len(stats.Failures))
+		os.Exit(exitStatusPartial)
+	}
+
 	log.Print("Done")
 }
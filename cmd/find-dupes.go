@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/spf13/cobra"
+)
+
+func NewFindDupesCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "find-dupes <paths...>",
+		Short: "Report the duplicate files without touching them",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   findDupesCommand,
+	}
+
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.Flags().String("format", "text", "Output format: text, json or csv")
+	cmd.Flags().String("hash", "sha256", "Hash used to compare the files: sha256 or highwayhash")
+	cmd.Flags().Int("workers", 1, "Number of workers to use")
+	cmd.Flags().StringArray("exclude", nil, "Skip the paths matching the given gitignore-style pattern")
+	cmd.Flags().StringArray("include", nil, "Process the paths matching the given gitignore-style pattern even if excluded")
+	cmd.Flags().Bool("no-ignore-files", false, "Do not read the "+ignore.FileName+" files found in the paths")
+	cmd.Flags().String("min-size", "", "Skip files smaller than the given size, like 4K or 1M")
+	cmd.Flags().String("max-size", "", "Skip files larger than the given size, like 4K or 1M")
+	cmd.Flags().String("older-than", "", "Skip files modified within the given time, like 12h or 7d")
+	cmd.Flags().StringSlice("type", nil, "Only process files of the given types: regular, no-setuid, no-exec")
+	cmd.Flags().BoolP("one-file-system", "x", false, "Do not descend into directories on other filesystems")
+	cmd.Flags().Bool("fail-fast", false, "Stop at the first file that cannot be read")
+	cmd.Flags().String("errors-output", "", "Write the files that could not be read as JSON to the given path")
+
+	return cmd
+}
+
+func findDupesCommand(cmd *cobra.Command, args []string) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	format, _ := cmd.Flags().GetString("format")
+	hashName, _ := cmd.Flags().GetString("hash")
+	workers, _ := cmd.Flags().GetInt("workers")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	include, _ := cmd.Flags().GetStringArray("include")
+	noIgnoreFiles, _ := cmd.Flags().GetBool("no-ignore-files")
+	oneFileSystem, _ := cmd.Flags().GetBool("one-file-system")
+	failFast, _ := cmd.Flags().GetBool("fail-fast")
+	errorsOutput, _ := cmd.Flags().GetString("errors-output")
+	filters, err := getFilters(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing filters: %v", err)
+	}
+
+	switch format {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("Invalid output format: %s", format)
+	}
+
+	// Create hash generator
+	h, err := hash.NewGenerator(hashName)
+	if err != nil {
+		log.Fatalf("Error creating hash generator: %v", err)
+	}
+
+	// Create processor
+	p := processor.NewFindDupesProcessor(args, h, workers)
+	p.Exclude = exclude
+	p.Include = include
+	p.NoIgnoreFiles = noIgnoreFiles
+	p.Filters = filters
+	p.OneFileSystem = oneFileSystem
+	p.FailFast = failFast
+
+	// Run the processor, stopping on SIGINT or SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Print("Looking for duplicates..")
+	err = dabadee.NewDaBaDee(p, verbose).Run(ctx)
+	if errors.Is(err, context.Canceled) {
+		exitInterrupted()
+	}
+	if err != nil && !isPartial(err) {
+		log.Fatalf("Error finding duplicates: %v", err)
+	}
+
+	// Print groups
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(struct {
+			Groups []processor.DupeGroup `json:"groups"`
+			Wasted int64                 `json:"wasted"`
+		}{p.Groups, p.Wasted()}, "", "  ")
+		if err != nil {
+			log.Fatalf("Error marshalling groups: %v", err)
+		}
+		fmt.Println(string(out))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"group", "hash", "size", "wasted", "path"})
+		for i, group := range p.Groups {
+			for _, path := range group.Paths {
+				w.Write([]string{
+					strconv.Itoa(i + 1), group.Hash,
+					strconv.FormatInt(group.Size, 10), strconv.FormatInt(group.Wasted, 10),
+					path,
+				})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatalf("Error writing groups: %v", err)
+		}
+	default:
+		for _, group := range p.Groups {
+			fmt.Printf("%d files of %s, %s wasted:\n", len(group.Paths), formatBytes(group.Size), formatBytes(group.Wasted))
+			for _, path := range group.Paths {
+				fmt.Printf("- %s\n", path)
+			}
+			fmt.Println()
+		}
+	}
+
+	log.Printf("Found %d groups of duplicates, %s wasted", len(p.Groups), formatBytes(p.Wasted()))
+
+	if len(p.Stats.Errors) > 0 {
+		reportFailures(p.Stats.Errors, errorsOutput)
+		log.Printf("Done, %d files could not be read", len(p.Stats.Errors))
+		os.Exit(exitStatusPartial)
+	}
+
+	log.Print("Done")
+}
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
 	"github.com/mirkobrombin/dabadee/pkg/storage"
 	"github.com/spf13/cobra"
 )
@@ -25,17 +27,29 @@ func findLinksCommand(cmd *cobra.Command, args []string) {
 	path, storagePath := args[0], args[1]
 	additionalPaths, _ := cmd.Flags().GetStringSlice("additional-paths")
 
-	// Create storage
-	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
-	if err != nil {
-		log.Fatalf("Error creating storage: %v", err)
-	}
-
-	// Find links
+	// Find links, with the daemon if one is running
 	log.Printf("Finding links to %s..", path)
-	links, err := s.FindLinks(path, additionalPaths)
-	if err != nil {
-		log.Fatalf("Error finding links: %v", err)
+	var links []string
+	if client := daemonClient(cmd); client != nil {
+		params := daemon.FindLinksParams{
+			Storage:         daemon.StorageParams{Root: absPath(storagePath)},
+			Path:            absPath(path),
+			AdditionalPaths: absPaths(additionalPaths),
+		}
+		err := client.Call(context.Background(), daemon.MethodFindLinks, params, &links)
+		if err != nil {
+			log.Fatalf("Error finding links: %v", err)
+		}
+	} else {
+		s, err := storage.OpenStorage(storagePath)
+		if err != nil {
+			log.Fatalf("Error opening storage: %v", err)
+		}
+
+		links, err = s.FindLinks(path, additionalPaths)
+		if err != nil {
+			log.Fatalf("Error finding links: %v", err)
+		}
 	}
 
 	// Print links
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewIndexCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index",
+		Short: "Manage the object index of a storage",
+	}
+
+	cmd.AddCommand(newIndexRebuildCommand())
+
+	return cmd
+}
+
+func newIndexRebuildCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rebuild <storage>",
+		Short: "Regenerate the object index from scratch",
+		Args:  cobra.ExactArgs(1),
+		Run:   indexRebuildCommand,
+	}
+
+	return cmd
+}
+
+func indexRebuildCommand(cmd *cobra.Command, args []string) {
+	storagePath := args[0]
+
+	// Open storage
+	s, err := storage.OpenStorage(storagePath)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+
+	// Rebuild index
+	log.Print("Rebuilding index..")
+	err = s.RebuildIndex()
+	if err != nil {
+		log.Fatalf("Error rebuilding index: %v", err)
+	}
+
+	log.Printf("Indexed %d objects", len(s.Index().Entries))
+	log.Print("Done")
+}
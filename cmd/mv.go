@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewMvCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mv [source...] [dest]",
+		Short: "Move files or directories through the storage, deduplicating them",
+		Args:  cobra.MinimumNArgs(2),
+		Run:   mvCommand,
+	}
+
+	cmd.Flags().BoolP("with-metadata", "m", false, "Include file metadata in hash calculation")
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.Flags().String("link-mode", string(storage.LinkHardlink), "How files are linked to the storage: hardlink, reflink, auto or symlink")
+	cmd.Flags().Bool("relative-symlinks", false, "Use relative symlinks with the symlink link mode")
+	cmd.Flags().String("layout", "flat", "Fan-out layout of a new storage, like 2x2 for 2 levels of 2 hash characters")
+	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
+	cmd.Flags().String("on-conflict", string(processor.ConflictOverwrite), "What to do with the paths already in the destination: overwrite, no-clobber, update-if-newer, backup or fail")
+	cmd.Flags().String("backup-suffix", processor.DefaultBackupSuffix, "Suffix of the paths moved aside with --on-conflict backup")
+	cmd.Flags().Int("workers", 1, "Number of workers to use")
+	cmd.Flags().StringArray("exclude", nil, "Skip the paths matching the given gitignore-style pattern")
+	cmd.Flags().StringArray("include", nil, "Process the paths matching the given gitignore-style pattern even if excluded")
+	cmd.Flags().Bool("no-ignore-files", false, "Do not read the "+ignore.FileName+" files found in the source")
+	cmd.Flags().String("min-size", "", "Skip files smaller than the given size, like 4K or 1M")
+	cmd.Flags().String("max-size", "", "Skip files larger than the given size, like 4K or 1M")
+	cmd.Flags().String("older-than", "", "Skip files modified within the given time, like 12h or 7d")
+	cmd.Flags().StringSlice("type", nil, "Only process files of the given types: regular, no-setuid, no-exec")
+	cmd.Flags().BoolP("one-file-system", "x", false, "Do not descend into directories on other filesystems")
+	cmd.Flags().Bool("fail-fast", false, "Stop at the first file that cannot be processed")
+	cmd.Flags().String("errors-output", "", "Write the files that could not be processed as JSON to the given path")
+	cmd.Flags().String("stats-json", "", "Write the statistics of the run as JSON to the given path, - for stdout")
+	cmd.Flags().Bool("no-progress", false, "Do not show the progress on the terminal")
+	cmd.Flags().Bool("dry-run", false, "Report what would be done without touching any file")
+
+	return cmd
+}
+
+func mvCommand(cmd *cobra.Command, args []string) {
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+	source, additionalSources := sources[0], sources[1:]
+	storagePath, _ := cmd.Flags().GetString("storage")
+	if storagePath == "" {
+		storagePath = GetDefaultStoragePath()
+	}
+	withMetadata, _ := cmd.Flags().GetBool("with-metadata")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	linkMode, _ := cmd.Flags().GetString("link-mode")
+	relativeSymlinks, _ := cmd.Flags().GetBool("relative-symlinks")
+	workers, _ := cmd.Flags().GetInt("workers")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	noProgress, _ := cmd.Flags().GetBool("no-progress")
+	failFast, _ := cmd.Flags().GetBool("fail-fast")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	include, _ := cmd.Flags().GetStringArray("include")
+	noIgnoreFiles, _ := cmd.Flags().GetBool("no-ignore-files")
+	oneFileSystem, _ := cmd.Flags().GetBool("one-file-system")
+	conflicts, err := getConflicts(cmd, processor.ConflictOverwrite)
+	if err != nil {
+		log.Fatalf("Error parsing conflict policy: %v", err)
+	}
+	filters, err := getFilters(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing filters: %v", err)
+	}
+	layout, err := getLayout(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %v", err)
+	}
+
+	// Hand the move to the daemon if one is running
+	if client := daemonClient(cmd); client != nil {
+		walkParams, err := getWalkParams(cmd)
+		if err != nil {
+			log.Fatalf("Error parsing filters: %v", err)
+		}
+		conflictParams, err := getConflictParams(cmd, processor.ConflictOverwrite)
+		if err != nil {
+			log.Fatalf("Error parsing conflict policy: %v", err)
+		}
+		params := daemon.CpParams{
+			WalkParams:        walkParams,
+			ConflictParams:    conflictParams,
+			Storage:           getStorageParams(cmd, storagePath),
+			Source:            absPath(source),
+			AdditionalSources: absPaths(additionalSources),
+			Dest:              absPath(dest),
+			Workers:           workers,
+			DryRun:            dryRun,
+		}
+
+		ctx, stop := newSignalContext()
+		defer stop()
+
+		log.Printf("Moving %s to %s with the daemon..", strings.Join(sources, ", "), dest)
+		var result daemon.RunResult
+		err = client.Call(ctx, daemon.MethodMv, params, &result)
+		if errors.Is(err, context.Canceled) || result.Interrupted {
+			exitInterrupted()
+		}
+		if err != nil {
+			log.Fatalf("Error during move: %v", err)
+		}
+
+		finishCp(cmd, result)
+		return
+	}
+
+	// Create storage
+	storageOpts := storage.StorageOptions{
+		Root:             storagePath,
+		WithMetadata:     withMetadata,
+		LinkMode:         storage.LinkMode(linkMode),
+		RelativeSymlinks: relativeSymlinks,
+		Layout:           layout,
+	}
+	s, err := storage.NewStorage(storageOpts)
+	if err != nil {
+		log.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Create processor
+	mvProc := processor.NewMvProcessor(source, dest, s, hash.NewSHA256Generator())
+	mvProc.AdditionalSources = additionalSources
+	mvProc.Workers = workers
+	mvProc.DryRun = dryRun
+	mvProc.Conflicts = conflicts
+	mvProc.Exclude = exclude
+	mvProc.Include = include
+	mvProc.NoIgnoreFiles = noIgnoreFiles
+	mvProc.Filters = filters
+	mvProc.OneFileSystem = oneFileSystem
+	mvProc.FailFast = failFast
+
+	// Run the processor, stopping on SIGINT or SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Printf("Moving %s to %s..", strings.Join(sources, ", "), dest)
+	d := dabadee.NewDaBaDee(mvProc, verbose)
+	stopProgress := func() {}
+	if !verbose && !noProgress {
+		stopProgress = startProgress(&mvProc.Events)
+	}
+	err = d.Run(ctx)
+	stopProgress()
+	if errors.Is(err, context.Canceled) {
+		exitInterrupted()
+	}
+	if err != nil && !isPartial(err) {
+		log.Fatalf("Error during move: %v", err)
+	}
+
+	finishCp(cmd, daemon.RunResult{Stats: &mvProc.Stats, DryRunReport: &mvProc.DryRunReport})
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// terminalWidth returns the width of the terminal on the given file, 80 if
+// unknown
+func terminalWidth(f *os.File) int {
+	var size struct {
+		rows, cols, x, y uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.cols == 0 {
+		return 80
+	}
+	return int(size.cols)
+}
+
+// isTerminal checks if the given file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress draws the progress of a run on stderr until the returned
+// function is called. Nothing is drawn if stderr is not a terminal
+func startProgress(events *processor.Events) (stop func()) {
+	if !isTerminal(os.Stderr) {
+		return func() {}
+	}
+
+	progress := processor.NewProgress()
+	events.Subscribe(progress.Handle)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				line := truncateLine(progressLine(progress.Snapshot()), terminalWidth(os.Stderr))
+				fmt.Fprint(os.Stderr, "\r\033[K"+line)
+			case <-done:
+				fmt.Fprint(os.Stderr, "\r\033[K")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// truncateLine cuts the given line to fit the given width, leaving the last
+// column free so the terminal does not wrap. It counts runes, not bytes, so
+// that paths are never cut in the middle of a character
+func truncateLine(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) < width {
+		return line
+	}
+	return string(runes[:width-1])
+}
+
+// progressLine describes the given progress in a single line
+func progressLine(s processor.ProgressSnapshot) string {
+	// The totals keep growing until the walker is done
+	more := ""
+	if !s.WalkDone {
+		more = "+"
+	}
+
+	percent := 0
+	if s.BytesDiscovered > 0 {
+		percent = int(s.BytesDone * 100 / s.BytesDiscovered)
+	}
+
+	eta := "?"
+	if left, ok := s.ETA(); ok {
+		eta = left.Round(time.Second).String()
+	}
+
+	line := fmt.Sprintf("%3d%% %d/%d%s files, %s/%s%s, %s saved, ETA %s",
+		percent, s.FilesDone, s.FilesDiscovered, more,
+		formatBytes(s.BytesDone), formatBytes(s.BytesDiscovered), more,
+		formatBytes(s.BytesSaved), eta)
+
+	// Show the file of the first busy worker
+	workers := make([]int, 0, len(s.Current))
+	for worker := range s.Current {
+		workers = append(workers, worker)
+	}
+	if len(workers) > 0 {
+		sort.Ints(workers)
+		line += " " + filepath.Base(s.Current[workers[0]])
+	}
+
+	return line
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewRecoverCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recover <storage>",
+		Short: "Fix the operations left half-finished by an interrupted run",
+		Args:  cobra.ExactArgs(1),
+		Run:   recoverCommand,
+	}
+
+	return cmd
+}
+
+func recoverCommand(cmd *cobra.Command, args []string) {
+	storagePath := args[0]
+
+	// Open storage, this already recovers the journal if the storage is
+	// not in use
+	s, err := storage.OpenStorage(storagePath)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+
+	// Recover, waiting for the storage to be released if in use
+	log.Print("Recovering storage..")
+	actions, err := s.Recover()
+	if err != nil {
+		log.Fatalf("Error recovering storage: %v", err)
+	}
+	actions = append(s.Recovered, actions...)
+
+	// Print actions
+	failed := false
+	for _, action := range actions {
+		if action.Error != "" {
+			failed = true
+			fmt.Printf("- %s %s (%s): %s failed: %s\n", action.Entry.Op, action.Entry.Path, action.Entry.Hash, action.Action, action.Error)
+			continue
+		}
+		fmt.Printf("- %s %s (%s): %s\n", action.Entry.Op, action.Entry.Path, action.Entry.Hash, action.Action)
+	}
+
+	if failed {
+		log.Fatal("Some operations could not be recovered")
+	}
+
+	log.Printf("Recovered %d operations", len(actions))
+	log.Print("Done")
+}
@@ -26,10 +26,10 @@ func rmOrphansCommand(cmd *cobra.Command, args []string) {
 	storagePath := args[0]
 	assumeYes, _ := cmd.Flags().GetBool("yes")
 
-	// Create storage
-	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	// Open storage
+	s, err := storage.OpenStorage(storagePath)
 	if err != nil {
-		log.Fatalf("Error creating storage: %v", err)
+		log.Fatalf("Error opening storage: %v", err)
 	}
 
 	// Prompt
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
 
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
 	"github.com/mirkobrombin/dabadee/pkg/storage"
 	"github.com/spf13/cobra"
 )
@@ -26,10 +28,15 @@ func rmCommand(cmd *cobra.Command, args []string) {
 	source, storagePath := args[0], args[1]
 	assumeYes, _ := cmd.Flags().GetBool("yes")
 
-	// Create storage
-	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
-	if err != nil {
-		log.Fatalf("Error creating storage: %v", err)
+	// Create storage, unless a daemon is running to do the removal
+	client := daemonClient(cmd)
+	var s *storage.Storage
+	var err error
+	if client == nil {
+		s, err = storage.OpenStorage(storagePath)
+		if err != nil {
+			log.Fatalf("Error opening storage: %v", err)
+		}
 	}
 
 	// Prompt
@@ -44,7 +51,15 @@ func rmCommand(cmd *cobra.Command, args []string) {
 	}
 
 	// Remove file
-	err = s.RemoveFile(source)
+	if client != nil {
+		params := daemon.RmParams{
+			Storage: daemon.StorageParams{Root: absPath(storagePath)},
+			Path:    absPath(source),
+		}
+		err = client.Call(context.Background(), daemon.MethodRm, params, nil)
+	} else {
+		err = s.RemoveFile(source)
+	}
 	if err != nil {
 		log.Fatalf("Error removing file: %v", err)
 	}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewStorageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "Manage a storage",
+	}
+
+	cmd.AddCommand(newMigrateLayoutCommand())
+
+	return cmd
+}
+
+func newMigrateLayoutCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate-layout <storage>",
+		Short: "Move the objects of a storage to a new fan-out layout",
+		Args:  cobra.ExactArgs(1),
+		Run:   migrateLayoutCommand,
+	}
+
+	cmd.Flags().String("layout", "2x2", "Fan-out layout to migrate to, like 2x2 for 2 levels of 2 hash characters or flat")
+
+	return cmd
+}
+
+func migrateLayoutCommand(cmd *cobra.Command, args []string) {
+	storagePath := args[0]
+	layout, err := getLayout(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %v", err)
+	}
+
+	// Open storage
+	s, err := storage.OpenStorage(storagePath)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+
+	// Migrate
+	log.Printf("Migrating storage from the %s layout to the %s layout..", s.Opts.Layout, layout)
+	moved, err := s.MigrateLayout(layout)
+	if err != nil {
+		log.Fatalf("Error migrating layout: %v", err)
+	}
+
+	log.Printf("Moved %d objects", moved)
+	log.Print("Done")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewUndedupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "undedup <path>",
+		Short: "Replace the links to the storage with independent copies",
+		Args:  cobra.ExactArgs(1),
+		Run:   undedupCommand,
+	}
+
+	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
+	cmd.Flags().String("manifest", "", "Manifest to restore the original metadata from")
+	cmd.Flags().Bool("gc", false, "Remove the objects left without links")
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+
+	return cmd
+}
+
+func undedupCommand(cmd *cobra.Command, args []string) {
+	path := args[0]
+	storagePath, _ := cmd.Flags().GetString("storage")
+	if storagePath == "" {
+		storagePath = GetDefaultStoragePath()
+	}
+	manifestPath, _ := cmd.Flags().GetString("manifest")
+	gc, _ := cmd.Flags().GetBool("gc")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	// Open storage
+	s, err := storage.OpenStorage(storagePath)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+
+	// Load manifest
+	opts := storage.MaterializeOptions{GC: gc}
+	if manifestPath != "" {
+		opts.Manifest, err = storage.LoadManifest(manifestPath)
+		if err != nil {
+			log.Fatalf("Error loading manifest: %v", err)
+		}
+	}
+
+	// Materialize
+	log.Printf("Materializing %s..", path)
+	report, err := s.Materialize(path, opts)
+	if err != nil {
+		log.Fatalf("Error materializing files: %v", err)
+	}
+
+	if verbose {
+		for _, p := range report.Materialized {
+			fmt.Printf("- materialized: %s\n", p)
+		}
+		for _, p := range report.Removed {
+			fmt.Printf("- removed: %s\n", p)
+		}
+	}
+
+	log.Printf("Materialized %d files, removed %d objects", len(report.Materialized), len(report.Removed))
+	log.Print("Done")
+}
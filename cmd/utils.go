@@ -1,8 +1,23 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
 )
 
 // GetDefaultStoragePath determines the default storage path based on user
@@ -21,3 +36,235 @@ func GetDefaultStoragePath() string {
 	// Running as non-root user
 	return filepath.Join(currentUser.HomeDir, ".dabadee/Storage")
 }
+
+// formatBytes formats a size in bytes in a human readable form
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// printDryRunReport logs what a dry run found, listing the files if verbose
+func printDryRunReport(report *processor.DryRunReport, verbose bool) {
+	if verbose {
+		for _, path := range report.Moved {
+			log.Printf("Would move to storage: %s", path)
+		}
+		for _, path := range report.Linked {
+			log.Printf("Would link: %s", path)
+		}
+		for _, path := range report.AlreadyLinked {
+			log.Printf("Already linked: %s", path)
+		}
+	}
+
+	log.Printf("Dry run: %d files would be moved to storage, %d linked, %d already linked, %d new objects, %s reclaimable",
+		len(report.Moved), len(report.Linked), len(report.AlreadyLinked), report.NewObjects, formatBytes(report.ReclaimableBytes))
+}
+
+// parseSize parses a size in bytes, optionally followed by a K, M, G or T
+// suffix for powers of 1024
+func parseSize(input string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(input)), "B")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i >= 0 && i == len(value)-1 {
+		for _, unit := range "KMGT" {
+			multiplier *= 1024
+			if byte(unit) == value[i] {
+				break
+			}
+		}
+		value = value[:i]
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+
+	return size * multiplier, nil
+}
+
+// parseAge parses a duration, also accepting a number of days like 7d
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// getFilters builds the file filters from the min-size, max-size, older-than
+// and type flags
+func getFilters(cmd *cobra.Command) ([]processor.Filter, error) {
+	var filters []processor.Filter
+
+	minSize, _ := cmd.Flags().GetString("min-size")
+	if minSize != "" {
+		size, err := parseSize(minSize)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, processor.MinSize(size))
+	}
+
+	maxSize, _ := cmd.Flags().GetString("max-size")
+	if maxSize != "" {
+		size, err := parseSize(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, processor.MaxSize(size))
+	}
+
+	olderThan, _ := cmd.Flags().GetString("older-than")
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, processor.OlderThan(age))
+	}
+
+	types, _ := cmd.Flags().GetStringSlice("type")
+	for _, name := range types {
+		filter, err := processor.TypeFilter(name)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
+
+// getConflicts returns how existing destinations are handled according to
+// the on-conflict and backup-suffix flags, fallback being the policy used
+// when the first is empty
+func getConflicts(cmd *cobra.Command, fallback processor.ConflictPolicy) (processor.Conflicts, error) {
+	onConflict, _ := cmd.Flags().GetString("on-conflict")
+	backupSuffix, _ := cmd.Flags().GetString("backup-suffix")
+
+	conflicts := processor.Conflicts{OnConflict: fallback, BackupSuffix: backupSuffix}
+	if onConflict != "" {
+		policy, err := processor.ParseConflictPolicy(onConflict)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts.OnConflict = policy
+	}
+
+	return conflicts, nil
+}
+
+// getLayout returns the layout given with the layout flag
+func getLayout(cmd *cobra.Command) (storage.Layout, error) {
+	layout, _ := cmd.Flags().GetString("layout")
+	return storage.ParseLayout(layout)
+}
+
+// newSignalContext returns a context cancelled on SIGINT or SIGTERM, after
+// which a second signal terminates the process right away
+func newSignalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+const (
+	// exitStatusPartial is the exit status of a run completed with some
+	// files that could not be processed, fatal errors exit with 1
+	exitStatusPartial = 2
+
+	// exitStatusInterrupted is the exit status of an interrupted run, the
+	// one used by shells for SIGINT
+	exitStatusInterrupted = 130
+)
+
+// exitInterrupted exits after an interrupted run
+func exitInterrupted() {
+	log.Print("Interrupted, run the command again to resume")
+	os.Exit(exitStatusInterrupted)
+}
+
+// isPartial checks if the error is about some files only, the run having
+// completed for the others
+func isPartial(err error) bool {
+	var partial *processor.PartialError
+	return errors.As(err, &partial)
+}
+
+// reportFailures logs the files that could not be processed, or writes them
+// as JSON to the given path if any
+func reportFailures(failures []*processor.FileError, outputPath string) {
+	if outputPath == "" {
+		for _, failure := range failures {
+			log.Printf("Failed: %v", failure)
+		}
+		return
+	}
+
+	log.Printf("Writing %d failures to %s..", len(failures), outputPath)
+	data, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		log.Fatalf("Error marshalling failures: %v", err)
+	}
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		log.Fatalf("Error writing failures: %v", err)
+	}
+}
+
+// reportConflicts logs the destinations that already existed, listing them
+// in verbose mode
+func reportConflicts(stats *processor.DedupStats, verbose bool) {
+	if len(stats.ConflictsSkipped) > 0 {
+		log.Printf("Left %d existing destinations as they are", len(stats.ConflictsSkipped))
+	}
+	if len(stats.ConflictsReplaced) > 0 {
+		log.Printf("Replaced %d existing destinations", len(stats.ConflictsReplaced))
+	}
+	if !verbose {
+		return
+	}
+	for _, path := range stats.ConflictsSkipped {
+		log.Printf("Left as is: %s", path)
+	}
+	for _, path := range stats.ConflictsReplaced {
+		log.Printf("Replaced: %s", path)
+	}
+}
+
+// writeStats writes the statistics of a run as JSON to the given path, or to
+// stdout if the path is -
+func writeStats(stats *processor.DedupStats, outputPath string) {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		log.Fatalf("Error marshalling stats: %v", err)
+	}
+
+	if outputPath == "-" {
+		fmt.Println(string(data))
+		return
+	}
+
+	log.Printf("Writing stats to %s..", outputPath)
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		log.Fatalf("Error writing stats: %v", err)
+	}
+}
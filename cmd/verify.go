@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <storage>",
+		Short: "Check that the objects in the storage match their hash",
+		Args:  cobra.ExactArgs(1),
+		Run:   verifyCommand,
+	}
+
+	cmd.Flags().Bool("json", false, "Print the report as JSON")
+	cmd.Flags().Bool("quarantine", false, "Move corrupted objects out of the storage")
+	cmd.Flags().String("hash", "sha256", "Hash the objects are named after: sha256 or highwayhash")
+
+	return cmd
+}
+
+func verifyCommand(cmd *cobra.Command, args []string) {
+	storagePath := args[0]
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	quarantine, _ := cmd.Flags().GetBool("quarantine")
+	hashName, _ := cmd.Flags().GetString("hash")
+
+	// Create hash generator
+	h, err := hash.NewGenerator(hashName)
+	if err != nil {
+		log.Fatalf("Error creating hash generator: %v", err)
+	}
+
+	// Verify, with the daemon if one is running
+	if !jsonOutput {
+		log.Print("Verifying storage..")
+	}
+	var report *storage.VerifyReport
+	if client := daemonClient(cmd); client != nil {
+		params := daemon.VerifyParams{
+			Storage:    daemon.StorageParams{Root: absPath(storagePath)},
+			Quarantine: quarantine,
+			Hash:       hashName,
+		}
+		err := client.Call(context.Background(), daemon.MethodVerify, params, &report)
+		if err != nil {
+			log.Fatalf("Error verifying storage: %v", err)
+		}
+	} else {
+		s, err := storage.OpenStorage(storagePath)
+		if err != nil {
+			log.Fatalf("Error opening storage: %v", err)
+		}
+
+		report, err = s.Verify(h, storage.VerifyOptions{Quarantine: quarantine})
+		if err != nil {
+			log.Fatalf("Error verifying storage: %v", err)
+		}
+	}
+
+	// Print report
+	if jsonOutput {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Error marshalling report: %v", err)
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, m := range report.Mismatches {
+			fmt.Printf("- mismatch: %s (got %s)\n", m.Path, m.Actual)
+		}
+		for _, path := range report.MissingMetadata {
+			fmt.Printf("- missing metadata: %s\n", path)
+		}
+		for _, path := range report.ZeroLinks {
+			fmt.Printf("- zero links: %s\n", path)
+		}
+		for _, path := range report.Stray {
+			fmt.Printf("- stray: %s\n", path)
+		}
+		for path, e := range report.Errors {
+			fmt.Printf("- error: %s: %s\n", path, e)
+		}
+		for _, path := range report.Quarantined {
+			fmt.Printf("- quarantined: %s\n", path)
+		}
+		log.Printf("Checked %d objects", report.Checked)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+
+	if !jsonOutput {
+		log.Print("Done")
+	}
+}
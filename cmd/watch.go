@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func NewWatchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch [dir]",
+		Short: "Keep deduplicating the files written to a directory",
+		Args:  cobra.ExactArgs(1),
+		Run:   watchCommand,
+	}
+
+	cmd.Flags().BoolP("with-metadata", "m", false, "Include file metadata in hash calculation")
+	cmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	cmd.Flags().String("link-mode", string(storage.LinkHardlink), "How files are linked to the storage: hardlink, reflink, auto or symlink")
+	cmd.Flags().Bool("relative-symlinks", false, "Use relative symlinks with the symlink link mode")
+	cmd.Flags().String("layout", "flat", "Fan-out layout of a new storage, like 2x2 for 2 levels of 2 hash characters")
+	cmd.Flags().String("storage", "", "Storage directory for deduplicated files")
+	cmd.Flags().Int("workers", 1, "Number of workers to use")
+	cmd.Flags().Bool("paranoid", false, "Compare files byte by byte with the stored ones before linking")
+	cmd.Flags().StringArray("exclude", nil, "Skip the paths matching the given gitignore-style pattern")
+	cmd.Flags().StringArray("include", nil, "Process the paths matching the given gitignore-style pattern even if excluded")
+	cmd.Flags().Bool("no-ignore-files", false, "Do not read the "+ignore.FileName+" files found in the directory")
+	cmd.Flags().String("min-size", "", "Skip files smaller than the given size, like 4K or 1M")
+	cmd.Flags().String("max-size", "", "Skip files larger than the given size, like 4K or 1M")
+	cmd.Flags().String("older-than", "", "Skip files modified within the given time, like 12h or 7d")
+	cmd.Flags().StringSlice("type", nil, "Only process files of the given types: regular, no-setuid, no-exec")
+	cmd.Flags().BoolP("one-file-system", "x", false, "Do not descend into directories on other filesystems")
+	cmd.Flags().Duration("debounce", 2*time.Second, "How long a written file must be left untouched before it is processed")
+	cmd.Flags().Bool("skip-initial-scan", false, "Only process the files written after the watch started")
+
+	return cmd
+}
+
+func watchCommand(cmd *cobra.Command, args []string) {
+	dir := args[0]
+	storagePath, _ := cmd.Flags().GetString("storage")
+	if storagePath == "" {
+		storagePath = GetDefaultStoragePath()
+	}
+	withMetadata, _ := cmd.Flags().GetBool("with-metadata")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	linkMode, _ := cmd.Flags().GetString("link-mode")
+	relativeSymlinks, _ := cmd.Flags().GetBool("relative-symlinks")
+	workers, _ := cmd.Flags().GetInt("workers")
+	paranoid, _ := cmd.Flags().GetBool("paranoid")
+	exclude, _ := cmd.Flags().GetStringArray("exclude")
+	include, _ := cmd.Flags().GetStringArray("include")
+	noIgnoreFiles, _ := cmd.Flags().GetBool("no-ignore-files")
+	oneFileSystem, _ := cmd.Flags().GetBool("one-file-system")
+	debounce, _ := cmd.Flags().GetDuration("debounce")
+	skipInitialScan, _ := cmd.Flags().GetBool("skip-initial-scan")
+	filters, err := getFilters(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing filters: %v", err)
+	}
+	layout, err := getLayout(cmd)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %v", err)
+	}
+
+	// Create storage
+	storageOpts := storage.StorageOptions{
+		Root:             storagePath,
+		WithMetadata:     withMetadata,
+		LinkMode:         storage.LinkMode(linkMode),
+		RelativeSymlinks: relativeSymlinks,
+		Layout:           layout,
+	}
+	s, err := storage.NewStorage(storageOpts)
+	if err != nil {
+		log.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Create hash generator
+	h := hash.NewSHA256Generator()
+
+	// Create processor, the files are processed by a DedupProcessor in
+	// batches as they are written
+	dedupProc := processor.NewDedupProcessor(dir, "", s, h, workers)
+	dedupProc.Paranoid = paranoid
+	dedupProc.Exclude = exclude
+	dedupProc.Include = include
+	dedupProc.NoIgnoreFiles = noIgnoreFiles
+	dedupProc.Filters = filters
+	dedupProc.OneFileSystem = oneFileSystem
+	dedupProc.Subscribe(func(event processor.ProgressEvent) {
+		switch event.Kind {
+		case processor.EventLinked:
+			log.Printf("Linked %s, saved %s", event.Path, formatBytes(event.Saved))
+		case processor.EventStored:
+			log.Printf("Stored %s", event.Path)
+		}
+	})
+
+	watchProc := processor.NewWatchProcessor(dedupProc, debounce)
+	watchProc.InitialScan = !skipInitialScan
+
+	// Run the processor until SIGINT or SIGTERM
+	ctx, stop := newSignalContext()
+	defer stop()
+
+	log.Printf("Watching %s..", dir)
+	d := dabadee.NewDaBaDee(watchProc, verbose)
+	err = d.Run(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("Error during watch: %v", err)
+	}
+
+	log.Print("Done")
+}
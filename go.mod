@@ -6,6 +6,7 @@ require (
 	github.com/minio/highwayhash v1.0.2
 	github.com/spf13/cobra v1.8.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.0.0-20190130150945-aca44879d564
 )
 
 require (
@@ -13,6 +14,5 @@ require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.0.0-20190130150945-aca44879d564 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -11,11 +11,23 @@ import (
 func main() {
 	var rootCmd = &cobra.Command{Use: "dabadee"}
 
+	rootCmd.PersistentFlags().Bool("no-daemon", false, "Do not hand the work to a running daemon")
+
+	rootCmd.AddCommand(cmd.NewCheckoutCommand())
 	rootCmd.AddCommand(cmd.NewCpCommand())
+	rootCmd.AddCommand(cmd.NewDaemonCommand())
 	rootCmd.AddCommand(cmd.NewDedupCommand())
+	rootCmd.AddCommand(cmd.NewFindDupesCommand())
 	rootCmd.AddCommand(cmd.NewFindLinksCommand())
+	rootCmd.AddCommand(cmd.NewIndexCommand())
+	rootCmd.AddCommand(cmd.NewMvCommand())
+	rootCmd.AddCommand(cmd.NewRecoverCommand())
 	rootCmd.AddCommand(cmd.NewRmOrphansCommand())
 	rootCmd.AddCommand(cmd.NewRmCommand())
+	rootCmd.AddCommand(cmd.NewStorageCommand())
+	rootCmd.AddCommand(cmd.NewUndedupCommand())
+	rootCmd.AddCommand(cmd.NewVerifyCommand())
+	rootCmd.AddCommand(cmd.NewWatchCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -3,6 +3,8 @@ package cache
 import (
 	"encoding/json"
 	"os"
+	"sync"
+	"time"
 )
 
 type CacheEntry struct {
@@ -14,6 +16,12 @@ type CacheEntry struct {
 type Cache struct {
 	Path    string                `json:"-"`
 	Entries map[string]CacheEntry `json:"entries"`
+
+	mu sync.Mutex
+
+	// modTime and size describe the file as last loaded or saved
+	modTime time.Time
+	size    int64
 }
 
 func Load(path string) (*Cache, error) {
@@ -29,13 +37,44 @@ func Load(path string) (*Cache, error) {
 	if err := json.NewDecoder(f).Decode(&c.Entries); err != nil {
 		return nil, err
 	}
+	if info, err := f.Stat(); err == nil {
+		c.modTime, c.size = info.ModTime(), info.Size()
+	}
 	return c, nil
 }
 
+// Reload replaces the entries with the ones on disk if the file has been
+// saved by someone else since it was last loaded or saved
+func (c *Cache) Reload() error {
+	if c == nil {
+		return nil
+	}
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return nil
+	}
+	loaded, err := Load(c.Path)
+	if err != nil {
+		return err
+	}
+	c.Entries, c.modTime, c.size = loaded.Entries, loaded.modTime, loaded.size
+	return nil
+}
+
 func (c *Cache) Save() error {
 	if c == nil {
 		return nil
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	f, err := os.Create(c.Path)
 	if err != nil {
 		return err
@@ -43,13 +82,21 @@ func (c *Cache) Save() error {
 	defer f.Close()
 	enc := json.NewEncoder(f)
 	enc.SetIndent("", "  ")
-	return enc.Encode(c.Entries)
+	if err := enc.Encode(c.Entries); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		c.modTime, c.size = info.ModTime(), info.Size()
+	}
+	return nil
 }
 
 func (c *Cache) Get(path string) (CacheEntry, bool) {
 	if c == nil {
 		return CacheEntry{}, false
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	e, ok := c.Entries[path]
 	return e, ok
 }
@@ -58,5 +105,16 @@ func (c *Cache) Update(path string, entry CacheEntry) {
 	if c == nil {
 		return
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Entries[path] = entry
 }
+
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Entries)
+}
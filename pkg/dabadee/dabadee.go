@@ -1,6 +1,10 @@
 package dabadee
 
-import "github.com/mirkobrombin/dabadee/pkg/processor"
+import (
+	"context"
+
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+)
 
 type DaBaDee struct {
 	Processor processor.Processor
@@ -15,7 +19,7 @@ func NewDaBaDee(p processor.Processor, verbose bool) *DaBaDee {
 	}
 }
 
-// Run starts the given processor
-func (d *DaBaDee) Run() error {
-	return d.Processor.Process(d.Verbose)
+// Run starts the given processor, which stops when the context is cancelled
+func (d *DaBaDee) Run(ctx context.Context) error {
+	return d.Processor.Process(ctx, d.Verbose)
 }
@@ -0,0 +1,256 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+)
+
+// The methods of the API, each taking the params and returning the result
+// of the same name
+const (
+	MethodDedup     = "dedup"
+	MethodCp        = "cp"
+	MethodMv        = "mv"
+	MethodRm        = "rm"
+	MethodFindLinks = "find-links"
+	MethodStats     = "stats"
+	MethodVerify    = "verify"
+)
+
+// Request is a call sent to the daemon, one per connection
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the answer of the daemon to a Request, Error is set if the call
+// failed
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// DefaultSocketPath returns the path of the socket of the daemon, taken from
+// the DABADEE_SOCKET environment variable if set
+func DefaultSocketPath() string {
+	if path := os.Getenv("DABADEE_SOCKET"); path != "" {
+		return path
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		return filepath.Join(dir, "dabadee.sock")
+	}
+
+	if os.Geteuid() == 0 {
+		return "/run/dabadee.sock"
+	}
+
+	// The temporary directory is shared, the socket goes in a directory only
+	// the user can enter
+	return filepath.Join(os.TempDir(), fmt.Sprintf("dabadee-%d", os.Geteuid()), "dabadee.sock")
+}
+
+// checkOwner fails if the given path belongs to another user than the
+// caller, or to root for the directories holding the socket
+func checkOwner(path string, allowRoot bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return os.ErrInvalid
+	}
+
+	uid := int(stat.Uid)
+	if uid != os.Geteuid() && !(allowRoot && uid == 0) {
+		return fmt.Errorf("%s is owned by uid %d instead of %d", path, uid, os.Geteuid())
+	}
+	return nil
+}
+
+// StorageParams selects the storage a call works on, the daemon keeps it open
+// between calls. All paths sent to the daemon must be absolute
+type StorageParams struct {
+	Root             string           `json:"root"`
+	WithMetadata     bool             `json:"with_metadata,omitempty"`
+	LinkMode         storage.LinkMode `json:"link_mode,omitempty"`
+	RelativeSymlinks bool             `json:"relative_symlinks,omitempty"`
+	Layout           storage.Layout   `json:"layout"`
+}
+
+// options returns the options to open the storage with
+func (p StorageParams) options() storage.StorageOptions {
+	return storage.StorageOptions{
+		Root:             p.Root,
+		WithMetadata:     p.WithMetadata,
+		LinkMode:         p.LinkMode,
+		RelativeSymlinks: p.RelativeSymlinks,
+		Layout:           p.Layout,
+	}
+}
+
+// WalkParams are the options of the walk of a directory, matching the ones
+// of processor.Walker
+type WalkParams struct {
+	Exclude       []string      `json:"exclude,omitempty"`
+	Include       []string      `json:"include,omitempty"`
+	NoIgnoreFiles bool          `json:"no_ignore_files,omitempty"`
+	MinSize       int64         `json:"min_size,omitempty"`
+	MaxSize       int64         `json:"max_size,omitempty"`
+	OlderThan     time.Duration `json:"older_than_ns,omitempty"`
+	Types         []string      `json:"types,omitempty"`
+	OneFileSystem bool          `json:"one_file_system,omitempty"`
+	FailFast      bool          `json:"fail_fast,omitempty"`
+}
+
+// apply sets the options on the given walker
+func (p WalkParams) apply(w *processor.Walker) error {
+	w.Exclude = p.Exclude
+	w.Include = p.Include
+	w.NoIgnoreFiles = p.NoIgnoreFiles
+	w.OneFileSystem = p.OneFileSystem
+	w.FailFast = p.FailFast
+
+	w.Filters = nil
+	if p.MinSize > 0 {
+		w.Filters = append(w.Filters, processor.MinSize(p.MinSize))
+	}
+	if p.MaxSize > 0 {
+		w.Filters = append(w.Filters, processor.MaxSize(p.MaxSize))
+	}
+	if p.OlderThan > 0 {
+		w.Filters = append(w.Filters, processor.OlderThan(p.OlderThan))
+	}
+	for _, name := range p.Types {
+		filter, err := processor.TypeFilter(name)
+		if err != nil {
+			return err
+		}
+		w.Filters = append(w.Filters, filter)
+	}
+
+	return nil
+}
+
+// ConflictParams are the options about the destinations that already exist,
+// matching processor.Conflicts. The policy of the processor is kept if none
+// is set
+type ConflictParams struct {
+	OnConflict   processor.ConflictPolicy `json:"on_conflict,omitempty"`
+	BackupSuffix string                   `json:"backup_suffix,omitempty"`
+}
+
+// apply sets the options on the given conflicts
+func (p ConflictParams) apply(c *processor.Conflicts) {
+	if p.OnConflict != "" {
+		c.OnConflict = p.OnConflict
+	}
+	c.BackupSuffix = p.BackupSuffix
+}
+
+// DedupParams are the params of MethodDedup, matching the options of
+// DedupProcessor
+type DedupParams struct {
+	WalkParams
+	ConflictParams
+
+	Storage           StorageParams `json:"storage"`
+	Source            string        `json:"source"`
+	AdditionalSources []string      `json:"additional_sources,omitempty"`
+	DestDir           string        `json:"dest_dir,omitempty"`
+	Workers           int           `json:"workers,omitempty"`
+	Paranoid          bool          `json:"paranoid,omitempty"`
+	DryRun            bool          `json:"dry_run,omitempty"`
+
+	// Manifest requests the manifest of the processed files in the result
+	Manifest bool `json:"manifest,omitempty"`
+}
+
+// CpParams are the params of MethodCp and MethodMv, matching the options of
+// CpProcessor
+type CpParams struct {
+	WalkParams
+	ConflictParams
+
+	Storage           StorageParams `json:"storage"`
+	Source            string        `json:"source"`
+	AdditionalSources []string      `json:"additional_sources,omitempty"`
+	Dest              string        `json:"dest"`
+	Workers           int           `json:"workers,omitempty"`
+	DryRun            bool          `json:"dry_run,omitempty"`
+}
+
+// RunResult is the result of MethodDedup, MethodCp and MethodMv
+type RunResult struct {
+	Stats        *processor.DedupStats   `json:"stats"`
+	DryRunReport *processor.DryRunReport `json:"dry_run_report,omitempty"`
+	Manifest     storage.Manifest        `json:"manifest,omitempty"`
+
+	// Interrupted is true if the run was stopped before completing, the
+	// completed files are recorded anyway
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// RmParams are the params of MethodRm
+type RmParams struct {
+	Storage StorageParams `json:"storage"`
+	Path    string        `json:"path"`
+}
+
+// FindLinksParams are the params of MethodFindLinks, its result is the list
+// of links found
+type FindLinksParams struct {
+	Storage         StorageParams `json:"storage"`
+	Path            string        `json:"path"`
+	AdditionalPaths []string      `json:"additional_paths,omitempty"`
+}
+
+// VerifyParams are the params of MethodVerify, its result is a
+// storage.VerifyReport
+type VerifyParams struct {
+	Storage    StorageParams `json:"storage"`
+	Quarantine bool          `json:"quarantine,omitempty"`
+
+	// Hash is the name of the hash the objects are named after, the one of
+	// the daemon is used if empty
+	Hash string `json:"hash,omitempty"`
+}
+
+// StatsResult is the result of MethodStats, which takes no params
+type StatsResult struct {
+	// Started is when the daemon started
+	Started time.Time `json:"started"`
+
+	// Requests is the number of calls handled
+	Requests int `json:"requests"`
+
+	// Storages holds the storages kept open
+	Storages []StorageStats `json:"storages"`
+}
+
+// StorageStats describes a storage kept open by the daemon
+type StorageStats struct {
+	Root string `json:"root"`
+
+	// Busy is true if a call is working on the storage, the other
+	// statistics are then left out
+	Busy bool `json:"busy,omitempty"`
+
+	// Objects is the number of objects in the index
+	Objects int `json:"objects"`
+
+	// CacheEntries is the number of files in the cache
+	CacheEntries int `json:"cache_entries"`
+
+	// LastRun holds the statistics of the last dedup or cp on the storage
+	LastRun *processor.DedupStats `json:"last_run,omitempty"`
+}
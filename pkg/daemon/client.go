@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Client calls a daemon listening on a Unix socket
+type Client struct {
+	// Socket is the path of the socket of the daemon
+	Socket string
+}
+
+// NewClient creates a new Client
+func NewClient(socket string) *Client {
+	return &Client{Socket: socket}
+}
+
+// Running checks if a daemon of the current user is listening on the given
+// socket
+func Running(socket string) bool {
+	if checkOwner(socket, false) != nil {
+		return false
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Call calls the given method, decoding its result into result if not nil.
+// If the context is cancelled the connection is closed, which makes the
+// daemon cancel the call, and the context error is returned
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	// A socket created by another user could be anyone's daemon
+	if err := checkOwner(c.Socket, false); err != nil {
+		return fmt.Errorf("connecting to daemon: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return fmt.Errorf("connecting to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	req := Request{Method: method}
+	if params != nil {
+		req.Params, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The connection is only closed from here to stop the call
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("sending request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	if result != nil && resp.Result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
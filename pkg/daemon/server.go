@@ -0,0 +1,425 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/cache"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+)
+
+// requestTimeout is how long clients have to send their request once
+// connected
+const requestTimeout = 10 * time.Second
+
+// Server keeps storages, with their index and cache, open in memory and
+// serves the calls of the clients on a Unix socket. Their config, index and
+// cache are reloaded under the storage lock when changed by other processes,
+// so commands bypassing the daemon are safe to run meanwhile
+type Server struct {
+	// Socket is the path of the Unix socket to listen on
+	Socket string
+
+	// HashGen is the hash generator to use
+	HashGen hash.Generator
+
+	// Verbose logs every call and the progress of the runs
+	Verbose bool
+
+	mu       sync.Mutex
+	started  time.Time
+	requests int
+	storages map[string]*openStorage
+}
+
+// openStorage is a storage kept open by the server, the calls working on it
+// are serialized
+type openStorage struct {
+	mu      sync.Mutex
+	storage *storage.Storage
+	cache   *cache.Cache
+	lastRun *processor.DedupStats
+}
+
+// NewServer creates a new Server
+func NewServer(socket string, hashGen hash.Generator) *Server {
+	return &Server{
+		Socket:   socket,
+		HashGen:  hashGen,
+		storages: make(map[string]*openStorage),
+	}
+}
+
+// Serve listens on the socket and handles the calls until the context is
+// cancelled. The runs in progress are then interrupted and waited for
+func (s *Server) Serve(ctx context.Context) error {
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.Socket)
+
+	s.mu.Lock()
+	s.started = time.Now()
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// listen creates the socket, replacing a stale one left by a daemon that did
+// not exit cleanly. Only the owner can connect, and its directory is created
+// private if missing
+func (s *Server) listen() (net.Listener, error) {
+	dir := filepath.Dir(s.Socket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating socket directory: %w", err)
+	}
+	if err := checkOwner(dir, true); err != nil {
+		return nil, fmt.Errorf("checking socket directory: %w", err)
+	}
+
+	if _, err := os.Lstat(s.Socket); err == nil {
+		if Running(s.Socket) {
+			return nil, fmt.Errorf("a daemon is already listening on %s", s.Socket)
+		}
+		if err := os.Remove(s.Socket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", s.Socket, err)
+	}
+
+	if err := os.Chmod(s.Socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// handle reads a request from the connection and writes the response. The
+// call is cancelled if the client goes away
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("decoding request: %v", err)})
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+
+	if s.Verbose {
+		log.Printf("Handling %s request", req.Method)
+	}
+
+	// Anything sent after the request, like a trailing newline, is
+	// discarded, only EOF or an error tell that the client went away
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	var resp Response
+	result, err := s.call(ctx, req)
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		if s.Verbose {
+			log.Printf("Error handling %s request: %v", req.Method, err)
+		}
+		resp.Error = err.Error()
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// call runs the method of the request
+func (s *Server) call(ctx context.Context, req Request) (interface{}, error) {
+	switch req.Method {
+	case MethodDedup:
+		var params DedupParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.dedup(ctx, params)
+	case MethodCp:
+		var params CpParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.cp(ctx, params, false)
+	case MethodMv:
+		var params CpParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.cp(ctx, params, true)
+	case MethodRm:
+		var params RmParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.withExistingStorage(params.Storage, func(st *openStorage) error {
+			return st.storage.RemoveFile(params.Path)
+		})
+	case MethodFindLinks:
+		var params FindLinksParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		var links []string
+		err := s.withExistingStorage(params.Storage, func(st *openStorage) (err error) {
+			// Locking reloads what other processes changed meanwhile
+			lockFile, err := st.storage.AcquireLock()
+			if err != nil {
+				return err
+			}
+			defer st.storage.ReleaseLock(lockFile)
+
+			links, err = st.storage.FindLinks(params.Path, params.AdditionalPaths)
+			return err
+		})
+		return links, err
+	case MethodVerify:
+		var params VerifyParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		h := s.HashGen
+		if params.Hash != "" {
+			var err error
+			h, err = hash.NewGenerator(params.Hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Verifying a mistyped path must not report a new, empty storage
+		var report *storage.VerifyReport
+		err := s.withExistingStorage(params.Storage, func(st *openStorage) (err error) {
+			report, err = st.storage.Verify(h, storage.VerifyOptions{Quarantine: params.Quarantine})
+			return err
+		})
+		return report, err
+	case MethodStats:
+		return s.stats(), nil
+	default:
+		return nil, fmt.Errorf("unknown method: %s", req.Method)
+	}
+}
+
+// decodeParams decodes the params of the request
+func decodeParams(req Request, params interface{}) error {
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return fmt.Errorf("decoding %s params: %w", req.Method, err)
+	}
+	return nil
+}
+
+// dedup deduplicates a directory
+func (s *Server) dedup(ctx context.Context, params DedupParams) (*RunResult, error) {
+	result := &RunResult{}
+	err := s.withStorage(params.Storage, func(st *openStorage) error {
+		workers := params.Workers
+		if workers < 1 {
+			workers = 1
+		}
+
+		p := processor.NewDedupProcessorWithCache(params.Source, params.DestDir, st.storage, st.cache, s.HashGen, workers)
+		p.AdditionalSources = params.AdditionalSources
+		p.Paranoid = params.Paranoid
+		p.DryRun = params.DryRun
+		if err := params.WalkParams.apply(&p.Walker); err != nil {
+			return err
+		}
+		params.ConflictParams.apply(&p.Conflicts)
+
+		err := p.Process(ctx, s.Verbose)
+		var partial *processor.PartialError
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.As(err, &partial) {
+			return err
+		}
+
+		result.Stats = &p.Stats
+		result.Interrupted = errors.Is(err, context.Canceled)
+		if params.DryRun {
+			result.DryRunReport = &p.DryRunReport
+		}
+		if params.Manifest {
+			result.Manifest = p.Manifest()
+		}
+		st.lastRun = &p.Stats
+		return nil
+	})
+
+	return result, err
+}
+
+// cp copies the sources, removing them once copied if move is set
+func (s *Server) cp(ctx context.Context, params CpParams, move bool) (*RunResult, error) {
+	result := &RunResult{}
+	err := s.withStorage(params.Storage, func(st *openStorage) error {
+		var p *processor.CpProcessor
+		if move {
+			p = processor.NewMvProcessor(params.Source, params.Dest, st.storage, s.HashGen).CpProcessor
+		} else {
+			p = processor.NewCpProcessor(params.Source, params.Dest, st.storage, s.HashGen)
+		}
+		p.AdditionalSources = params.AdditionalSources
+		if params.Workers > 0 {
+			p.Workers = params.Workers
+		}
+		p.DryRun = params.DryRun
+		if err := params.WalkParams.apply(&p.Walker); err != nil {
+			return err
+		}
+		params.ConflictParams.apply(&p.Conflicts)
+
+		err := p.Process(ctx, s.Verbose)
+		var partial *processor.PartialError
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.As(err, &partial) {
+			return err
+		}
+		result.Interrupted = errors.Is(err, context.Canceled)
+
+		result.Stats = &p.Stats
+		if params.DryRun {
+			result.DryRunReport = &p.DryRunReport
+		}
+		st.lastRun = &p.Stats
+		return nil
+	})
+
+	return result, err
+}
+
+// withStorage calls fn with the given storage, opening it the first time it
+// is used. Only one call at a time works on a storage
+func (s *Server) withStorage(params StorageParams, fn func(st *openStorage) error) error {
+	if !filepath.IsAbs(params.Root) {
+		return fmt.Errorf("storage path must be absolute: %s", params.Root)
+	}
+	root := filepath.Clean(params.Root)
+
+	s.mu.Lock()
+	st, ok := s.storages[root]
+	if !ok {
+		st = &openStorage{}
+		s.storages[root] = st
+	}
+	s.mu.Unlock()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.storage == nil {
+		opts := params.options()
+		opts.Root = root
+		storage, err := storage.NewStorage(opts)
+		if err != nil {
+			return fmt.Errorf("opening storage: %w", err)
+		}
+
+		c, err := processor.LoadCache(storage)
+		if err != nil {
+			return fmt.Errorf("loading cache: %w", err)
+		}
+
+		st.storage = storage
+		st.cache = c
+		if s.Verbose {
+			log.Printf("Opened storage %s", root)
+		}
+	}
+
+	return fn(st)
+}
+
+// withExistingStorage is withStorage for the calls which must not create the
+// storage if the path holds none
+func (s *Server) withExistingStorage(params StorageParams, fn func(st *openStorage) error) error {
+	if filepath.IsAbs(params.Root) {
+		if err := storage.CheckStorage(params.Root); err != nil {
+			return err
+		}
+	}
+
+	return s.withStorage(params, fn)
+}
+
+// stats describes the daemon and the storages it keeps open
+func (s *Server) stats() *StatsResult {
+	s.mu.Lock()
+	result := &StatsResult{Started: s.started, Requests: s.requests}
+	storages := make(map[string]*openStorage, len(s.storages))
+	for root, st := range s.storages {
+		storages[root] = st
+	}
+	s.mu.Unlock()
+
+	for root, st := range storages {
+		// Storages in use are only listed, their statistics are changing
+		if !st.mu.TryLock() {
+			result.Storages = append(result.Storages, StorageStats{Root: root, Busy: true})
+			continue
+		}
+		if st.storage != nil {
+			result.Storages = append(result.Storages, StorageStats{
+				Root:         root,
+				Objects:      st.storage.Index().Len(),
+				CacheEntries: st.cache.Len(),
+				LastRun:      st.lastRun,
+			})
+		}
+		st.mu.Unlock()
+	}
+	sort.Slice(result.Storages, func(i, j int) bool {
+		return result.Storages[i].Root < result.Storages[j].Root
+	})
+
+	return result
+}
@@ -1,6 +1,7 @@
 package hash
 
 import (
+	"fmt"
 	"os"
 )
 
@@ -17,3 +18,16 @@ type Generator interface {
 	// the pattern "<file hash>-<metadata hash>"
 	ComputeFullHash(path string) (string, error)
 }
+
+// NewGenerator returns the generator with the given name, one of sha256 and
+// highwayhash
+func NewGenerator(name string) (Generator, error) {
+	switch name {
+	case "sha256":
+		return NewSHA256Generator(), nil
+	case "highwayhash":
+		return NewHighwayHashGenerator(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash: %s", name)
+	}
+}
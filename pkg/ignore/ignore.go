@@ -0,0 +1,227 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the name of the files holding the ignore rules of the directory
+// they are in and its subdirectories
+const FileName = ".dabadeeignore"
+
+// Rule is a gitignore-style pattern, scoped to a base directory
+type Rule struct {
+	// Pattern is the pattern as written
+	Pattern string
+
+	// Base is the directory the pattern is relative to
+	Base string
+
+	// Source is where the rule comes from, a flag or an ignore file
+	Source string
+
+	// Line is the line of the ignore file defining the rule, 0 for flags
+	Line int
+
+	// Negate re-includes the paths matched by the pattern
+	Negate bool
+
+	// DirOnly restricts the pattern to directories
+	DirOnly bool
+
+	segments []string
+}
+
+// ParseRule parses a gitignore-style pattern, returning false for blank lines
+// and comments
+func ParseRule(pattern, base, source string, line int) (Rule, bool, error) {
+	rule := Rule{Pattern: pattern, Base: base, Source: source, Line: line}
+
+	p := strings.TrimRight(pattern, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(p, "!") {
+		rule.Negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		rule.DirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	// Patterns without a slash match at any depth, the others are anchored
+	// to the base directory
+	if !strings.Contains(p, "/") {
+		p = "**/" + p
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return rule, false, fmt.Errorf("invalid pattern %q", pattern)
+	}
+
+	rule.segments = strings.Split(p, "/")
+	for _, segment := range rule.segments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return rule, false, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return rule, true, nil
+}
+
+// Match checks if the rule matches the given path, paths outside the base
+// directory never match
+func (r Rule) Match(path string, isDir bool) bool {
+	if r.DirOnly && !isDir {
+		return false
+	}
+
+	rel, err := filepath.Rel(r.Base, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	return matchSegments(r.segments, strings.Split(rel, string(filepath.Separator)))
+}
+
+// String describes the rule like git check-ignore does
+func (r Rule) String() string {
+	return fmt.Sprintf("%s:%d:%s", r.Source, r.Line, r.Pattern)
+}
+
+// matchSegments matches the path segments against the pattern ones, where
+// "**" matches any number of segments, at least one if trailing
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(path) > 0
+		}
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchSegments(pattern[1:], path[1:])
+}
+
+// LoadFile parses the rules in the given ignore file, scoped to the directory
+// it is in
+func LoadFile(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []Rule
+	base := filepath.Dir(path)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule, ok, err := ParseRule(scanner.Text(), base, path, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// Matcher decides which paths are ignored, combining global rules with the
+// ones of the ignore files found in each directory. Like gitignore, the last
+// matching rule wins and the ignore files of deeper directories take
+// precedence
+type Matcher struct {
+	rules  []Rule
+	scoped map[string][]Rule
+	loaded []string
+}
+
+// NewMatcher creates a Matcher with the given global rules
+func NewMatcher(rules []Rule) *Matcher {
+	return &Matcher{rules: rules, scoped: make(map[string][]Rule)}
+}
+
+// LoadDir loads the ignore file of the given directory, if any
+func (m *Matcher) LoadDir(dir string) error {
+	rules, err := LoadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	dir = filepath.Clean(dir)
+	if _, ok := m.scoped[dir]; !ok {
+		m.loaded = append(m.loaded, dir)
+	}
+	m.scoped[dir] = rules
+	return nil
+}
+
+// Match returns the last rule matching the given path, the path is ignored if
+// a rule is returned and it is not negated
+func (m *Matcher) Match(path string, isDir bool) *Rule {
+	path = filepath.Clean(path)
+
+	// Collect the ancestors holding rules, from the outermost
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, ok := m.scoped[dir]; ok {
+			dirs = append([]string{dir}, dirs...)
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	var match *Rule
+	for i := range m.rules {
+		if m.rules[i].Match(path, isDir) {
+			match = &m.rules[i]
+		}
+	}
+	for _, dir := range dirs {
+		rules := m.scoped[dir]
+		for i := range rules {
+			if rules[i].Match(path, isDir) {
+				match = &rules[i]
+			}
+		}
+	}
+
+	return match
+}
+
+// Rules returns every rule known to the matcher, the global ones first and
+// then the ones of each ignore file in the order they were loaded
+func (m *Matcher) Rules() []Rule {
+	rules := append([]Rule(nil), m.rules...)
+	for _, dir := range m.loaded {
+		rules = append(rules, m.scoped[dir]...)
+	}
+	return rules
+}
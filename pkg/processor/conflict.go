@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ConflictPolicy decides what happens when the destination of a link already
+// exists
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces the destination with the link
+	ConflictOverwrite ConflictPolicy = "overwrite"
+
+	// ConflictNoClobber leaves the destination as it is
+	ConflictNoClobber ConflictPolicy = "no-clobber"
+
+	// ConflictUpdateIfNewer replaces the destination only if the source was
+	// modified after it
+	ConflictUpdateIfNewer ConflictPolicy = "update-if-newer"
+
+	// ConflictBackup moves the destination aside, appending BackupSuffix to
+	// its name, before linking
+	ConflictBackup ConflictPolicy = "backup"
+
+	// ConflictFail reports the file as failed, leaving the destination as it
+	// is
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// DefaultBackupSuffix is the suffix of the backups made by ConflictBackup if
+// none is set
+const DefaultBackupSuffix = "~"
+
+// ErrDestinationExists is the error of the files whose destination exists
+// with ConflictFail
+var ErrDestinationExists = errors.New("destination already exists")
+
+// ParseConflictPolicy returns the policy with the given name
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictOverwrite, ConflictNoClobber, ConflictUpdateIfNewer, ConflictBackup, ConflictFail:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q", name)
+	}
+}
+
+// Conflicts configures how a processor handles the destinations that already
+// exist. A destination already linked to the right object is not a conflict
+type Conflicts struct {
+	// OnConflict is the policy applied to the existing destinations
+	OnConflict ConflictPolicy
+
+	// BackupSuffix is appended to the destinations moved aside by
+	// ConflictBackup, DefaultBackupSuffix if empty
+	BackupSuffix string
+}
+
+// conflictAction is what has to be done at a destination before linking
+type conflictAction int
+
+const (
+	// destFree means the destination does not exist
+	destFree conflictAction = iota
+
+	// destLinked means the destination is already linked to the object
+	destLinked
+
+	// destSkip means the destination is left as it is
+	destSkip
+
+	// destReplace means the destination is removed
+	destReplace
+
+	// destBackup means the destination is moved aside
+	destBackup
+)
+
+// check decides what to do at dest before linking it to object, info being
+// the source of the link. It does not touch anything, so it is safe in dry
+// runs
+func (c *Conflicts) check(dest, object string, info os.FileInfo) (conflictAction, error) {
+	destInfo, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return destFree, nil
+	}
+	if err != nil {
+		return destFree, err
+	}
+
+	// Symlinks to the object are followed
+	if linkedInfo, err := os.Stat(dest); err == nil {
+		if objectInfo, err := os.Stat(object); err == nil && os.SameFile(linkedInfo, objectInfo) {
+			return destLinked, nil
+		}
+	}
+
+	switch c.OnConflict {
+	case ConflictOverwrite:
+		return destReplace, nil
+	case ConflictNoClobber:
+		return destSkip, nil
+	case ConflictUpdateIfNewer:
+		if info.ModTime().After(destInfo.ModTime()) {
+			return destReplace, nil
+		}
+		return destSkip, nil
+	case ConflictBackup:
+		return destBackup, nil
+	case ConflictFail:
+		return destFree, ErrDestinationExists
+	default:
+		return destFree, fmt.Errorf("unknown conflict policy %q", c.OnConflict)
+	}
+}
+
+// apply makes room at dest according to the action, recording the conflict
+// in stats, and reports if the link has to be created
+func (c *Conflicts) apply(dest string, action conflictAction, stats *DedupStats) (bool, error) {
+	switch action {
+	case destFree:
+		return true, nil
+	case destLinked:
+		return false, nil
+	case destSkip:
+		stats.addConflict(dest, false)
+		return false, nil
+	case destReplace:
+		if err := os.Remove(dest); err != nil {
+			return false, err
+		}
+	case destBackup:
+		suffix := c.BackupSuffix
+		if suffix == "" {
+			suffix = DefaultBackupSuffix
+		}
+		if err := os.Rename(dest, dest+suffix); err != nil {
+			return false, err
+		}
+	}
+
+	stats.addConflict(dest, true)
+	return true, nil
+}
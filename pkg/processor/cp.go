@@ -1,47 +1,433 @@
 package processor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mirkobrombin/dabadee/pkg/hash"
 	"github.com/mirkobrombin/dabadee/pkg/storage"
 )
 
-// CpProcessor is a processor that links a stored file to a destination. If the
-// file is not already in storage, it is moved there and link the source to it
-// before linking it to the destination
+// CpProcessor is a processor that copies a file or a directory tree by
+// linking the files to the storage. Files not already in storage are moved
+// there and their source is linked to them before linking the destination.
+// Directories are recreated with their permissions, ownership and times,
+// symlinks are recreated as they are
 type CpProcessor struct {
-	// SourceFile is the path of the file to be linked
-	SourceFile string
+	// Walker decides which files are copied when the source is a directory
+	Walker
 
-	// DestFile is the path of the link to be created
-	DestFile string
+	// Events sends the progress of the copy to its subscribers
+	Events
+
+	// Conflicts decides what happens to the destinations that already
+	// exist, they are overwritten by default
+	Conflicts
+
+	// Source is the path of the file or directory to copy
+	Source string
+
+	// AdditionalSources holds more files or directories copied in the same
+	// run, into Dest which must then be a directory
+	AdditionalSources []string
+
+	// Dest is the path of the copy, mirroring Source
+	Dest string
 
 	// Storage is the storage interface to use
 	Storage *storage.Storage
 
 	// HashGen is the hash generator to use
 	HashGen hash.Generator
+
+	// Workers is the number of files copied at the same time
+	Workers int
+
+	// DryRun makes the processor only hash the files and consult the
+	// storage, reporting in DryRunReport what would be done
+	DryRun bool
+
+	// DryRunReport holds what would be done, filled in dry-run mode
+	DryRunReport DryRunReport
+
+	// Stats holds statistics about the copy
+	Stats DedupStats
+
+	// move makes the copy remove each source once its destination is
+	// verified, see MvProcessor
+	move bool
+}
+
+// cpJob is a source or a file found in a source tree, waiting to be copied
+type cpJob struct {
+	path string
+	dest string
+	info os.FileInfo
+}
+
+// copiedDir is a directory recreated in the destination, its attributes are
+// applied once its content is complete
+type copiedDir struct {
+	source string
+	path   string
+	info   os.FileInfo
 }
 
 // NewCpProcessor creates a new CpProcessor
-func NewCpProcessor(sourceFile, destFile string, storage *storage.Storage, hashGen hash.Generator) *CpProcessor {
+func NewCpProcessor(source, dest string, storage *storage.Storage, hashGen hash.Generator) *CpProcessor {
 	return &CpProcessor{
-		SourceFile: sourceFile,
-		DestFile:   destFile,
-		Storage:    storage,
-		HashGen:    hashGen,
+		Source:  source,
+		Dest:    dest,
+		Storage: storage,
+		HashGen: hashGen,
+		Workers: 1,
+		Conflicts: Conflicts{
+			OnConflict: ConflictOverwrite,
+		},
+	}
+}
+
+// Process copies the source to the destination. A single file is copied as
+// is, failing with its error. Once the context is cancelled no more files are
+// copied, and if some files of a directory or some of the sources cannot be
+// copied a PartialError listing them is returned
+func (p *CpProcessor) Process(ctx context.Context, verbose bool) error {
+	lockFile, err := p.Storage.AcquireLock()
+	if err != nil {
+		return err
+	}
+	defer p.Storage.ReleaseLock(lockFile)
+
+	if _, err := ParseConflictPolicy(string(p.OnConflict)); err != nil {
+		return err
+	}
+
+	targets, err := p.targets()
+	if err != nil {
+		return err
+	}
+
+	// Renames and hardlinks cannot cross filesystems, fail before touching
+	// anything if the sources or the destination are not on the storage
+	// device, unless symlinks are used
+	for _, target := range targets {
+		err = p.Storage.CheckLinkable(target.path, p.Dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(targets) > 1 || targets[0].info.IsDir() {
+		return p.copyTree(ctx, targets, verbose)
+	}
+	target := targets[0]
+
+	start := time.Now()
+	p.Stats.reset(1)
+	p.Stats.WalkStats = WalkStats{}
+	p.emit(ProgressEvent{Kind: EventDiscovered, Path: target.path, Size: target.info.Size()})
+	p.emit(ProgressEvent{Kind: EventWalkDone})
+
+	err = p.copyFile(ctx, 0, target.path, target.dest, target.info, verbose)
+	p.Stats.addWork(0, target.info.Size(), time.Since(start))
+	if err != nil && !isInterruption(ctx, err) {
+		p.emit(ProgressEvent{Kind: EventFailed, Path: target.path, Size: target.info.Size(), Err: err})
+		p.Stats.addFailure(asFileError(target.path, err))
+	}
+	p.Stats.finish(time.Since(start))
+	if err != nil || p.DryRun {
+		return err
+	}
+
+	err = p.Storage.SaveIndex()
+	if err != nil {
+		return fmt.Errorf("saving index: %w", err)
 	}
+
+	return nil
+}
+
+// targets returns the sources with their destination. Like cp does, with
+// several sources or a single file copied to a directory the sources are
+// copied into the destination with their base name
+func (p *CpProcessor) targets() ([]cpJob, error) {
+	sources := append([]string{p.Source}, p.AdditionalSources...)
+
+	destInfo, err := os.Stat(p.Dest)
+	destIsDir := err == nil && destInfo.IsDir()
+	if len(sources) > 1 && !destIsDir {
+		return nil, fmt.Errorf("destination %s is not a directory", p.Dest)
+	}
+
+	targets := make([]cpJob, 0, len(sources))
+	seen := make(map[string]string)
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+
+		dest := p.Dest
+		if len(sources) > 1 || destIsDir && !info.IsDir() {
+			dest = filepath.Join(p.Dest, filepath.Base(source))
+		}
+		if samePath(source, dest) {
+			return nil, fmt.Errorf("%s and %s are the same file", source, dest)
+		}
+		// Sources sharing a base name would be merged into one destination
+		if other, ok := seen[dest]; ok {
+			return nil, fmt.Errorf("sources %s and %s would both be copied to %s", other, source, dest)
+		}
+		seen[dest] = source
+		targets = append(targets, cpJob{path: source, dest: dest, info: info})
+	}
+
+	return targets, nil
+}
+
+// copyTree copies the given sources with the workers
+func (p *CpProcessor) copyTree(ctx context.Context, targets []cpJob, verbose bool) error {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	start := time.Now()
+
+	// In fail-fast mode the first failure stops the copy as a cancellation
+	// would
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.Stats.reset(workers)
+
+	jobs := make(chan cpJob, workers)
+	var wg sync.WaitGroup
+
+	// Start workers
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				jobStart := time.Now()
+				err := p.copyFile(ctx, worker, job.path, job.dest, job.info, verbose)
+				p.Stats.addWork(worker, job.info.Size(), time.Since(jobStart))
+				if err != nil && !isInterruption(ctx, err) {
+					if verbose {
+						log.Printf("Error copying file %s: %v", job.path, err)
+					}
+					p.emit(ProgressEvent{Kind: EventFailed, Worker: worker, Path: job.path, Size: job.info.Size(), Err: err})
+					p.Stats.addFailure(asFileError(job.path, err))
+					if p.FailFast {
+						cancel()
+					}
+				}
+			}
+		}(i)
+	}
+
+	// Feed the workers
+	dirs, err := p.walk(ctx, targets, verbose, jobs)
+	close(jobs)
+	wg.Wait()
+
+	// Directories are complete, their times can be set. Deepest ones come
+	// first, so setting them does not change the times of their parents
+	if !p.DryRun {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := storage.CopyAttributes(dirs[i].path, dirs[i].info); err != nil {
+				p.Stats.addFailure(&FileError{Path: dirs[i].path, Stage: StageCopy, Err: err})
+			}
+		}
+	}
+
+	// Moved directories are removed once empty, the ones still holding
+	// files not moved are left
+	if p.move && !p.DryRun && err == nil {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			err := os.Remove(dirs[i].source)
+			if err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+				p.Stats.addFailure(&FileError{Path: dirs[i].source, Stage: StageRemove, Err: err})
+			}
+		}
+	}
+
+	// Stopped by a failure, which is already recorded
+	var fileErr *FileError
+	if errors.As(err, &fileErr) || errors.Is(err, context.Canceled) && parent.Err() == nil {
+		err = nil
+	}
+	p.Stats.finish(time.Since(start))
+	if err == nil && len(p.Stats.Failures) > 0 {
+		err = &PartialError{Errors: p.Stats.Failures}
+	}
+	if p.DryRun {
+		return err
+	}
+
+	// Save the index of the completed files, even if the walk failed or was
+	// interrupted
+	if err := p.Storage.SaveIndex(); err != nil {
+		return fmt.Errorf("saving index: %w", err)
+	}
+	return err
+}
+
+// walk sends the given sources to the workers, walking the directories. The
+// directories are returned in the order they were created
+func (p *CpProcessor) walk(ctx context.Context, targets []cpJob, verbose bool, jobs chan<- cpJob) ([]copiedDir, error) {
+	p.Stats.WalkStats = WalkStats{Ignored: make(map[string]string)}
+
+	var dirs []copiedDir
+	for _, target := range targets {
+		if !target.info.IsDir() {
+			if err := p.send(ctx, jobs, target); err != nil {
+				return dirs, err
+			}
+			continue
+		}
+
+		var stats WalkStats
+		treeDirs, err := p.walkTree(ctx, target.path, target.dest, verbose, &stats, jobs)
+		dirs = append(dirs, treeDirs...)
+		p.Stats.WalkStats.merge(stats)
+		if err != nil {
+			return dirs, err
+		}
+	}
+	p.emit(ProgressEvent{Kind: EventWalkDone})
+
+	return dirs, nil
+}
+
+// send sends a file to the workers
+func (p *CpProcessor) send(ctx context.Context, jobs chan<- cpJob, job cpJob) error {
+	p.emit(ProgressEvent{Kind: EventDiscovered, Path: job.path, Size: job.info.Size()})
+	select {
+	case jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// walkTree walks the source directory, recreating its directories and
+// symlinks in the destination and sending its files to the workers. The
+// directories are returned in the order they were created
+func (p *CpProcessor) walkTree(ctx context.Context, source, destRoot string, verbose bool, stats *WalkStats, jobs chan<- cpJob) ([]copiedDir, error) {
+	st, err := p.start(source, verbose, stats)
+	if err != nil {
+		return nil, err
+	}
+	defer st.end()
+
+	// The copy may be made inside the source, it is not copied again
+	skipDest := ""
+	if rel, err := filepath.Rel(source, destRoot); err == nil && rel != "." && filepath.IsLocal(rel) {
+		skipDest = filepath.Join(source, rel)
+	}
+
+	var dirs []copiedDir
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			if path == source {
+				return err
+			}
+			if verbose {
+				log.Printf("Error accessing path %s: %v", path, err)
+			}
+			return p.fail(stats, &FileError{Path: path, Stage: StageWalk, Err: err})
+		}
+
+		if path == skipDest {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(destRoot, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if skip, err := p.skip(st, path, info); skip {
+				return err
+			}
+			if p.DryRun {
+				return nil
+			}
+			if verbose {
+				log.Printf("Recreating symlink: %s", dest)
+			}
+			if err := p.copySymlink(path, dest, info); err != nil {
+				return p.fail(stats, &FileError{Path: path, Stage: StageCopy, Err: err})
+			}
+			if p.move {
+				if err := removeSymlink(path, dest); err != nil {
+					return p.fail(stats, asFileError(path, err))
+				}
+			}
+			return nil
+		case info.IsDir():
+			if _, err := p.visit(st, path, info); err != nil {
+				return err
+			}
+			if p.DryRun {
+				return nil
+			}
+			if verbose {
+				log.Printf("Creating directory: %s", dest)
+			}
+			// Written with owner permissions first, the ones of the source
+			// are applied once the copy is complete
+			err := os.MkdirAll(dest, 0700)
+			if err != nil {
+				if err := p.fail(stats, &FileError{Path: path, Stage: StageCopy, Err: err}); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, copiedDir{source: path, path: dest, info: info})
+			return nil
+		}
+
+		ok, err := p.visit(st, path, info)
+		if !ok || err != nil {
+			return err
+		}
+
+		if verbose {
+			log.Printf("Adding file to job queue: %s", path)
+		}
+		return p.send(ctx, jobs, cpJob{path: path, dest: dest, info: info})
+	})
+
+	return dirs, err
 }
 
-// Process processes the file and creates a link at the destination
-func (p *CpProcessor) Process(verbose bool) (err error) {
+// copyFile links the file at the given path to the destination through the
+// storage, nothing is touched if the context is cancelled while hashing
+func (p *CpProcessor) copyFile(ctx context.Context, worker int, path, dest string, info os.FileInfo, verbose bool) (err error) {
 	if verbose {
-		log.Printf("Processing file: %s", p.SourceFile)
+		log.Printf("Processing file: %s", path)
 	}
+	p.emit(ProgressEvent{Kind: EventStarted, Worker: worker, Path: path, Size: info.Size()})
 
 	// Compute file hash
 	var finalHash string
@@ -50,26 +436,68 @@ func (p *CpProcessor) Process(verbose bool) (err error) {
 		if verbose {
 			log.Println("Computing full hash with metadata")
 		}
-		finalHash, err = p.HashGen.ComputeFullHash(p.SourceFile)
+		finalHash, err = p.HashGen.ComputeFullHash(path)
 		if err != nil {
-			return fmt.Errorf("computing full hash: %w", err)
+			return newFileError(path, StageHash, fmt.Errorf("computing full hash: %w", err))
 		}
 	} else {
 		if verbose {
 			log.Println("Computing content hash without metadata")
 		}
-		finalHash, err = p.HashGen.ComputeFileHash(p.SourceFile)
+		finalHash, err = p.HashGen.ComputeFileHash(path)
 		if err != nil {
-			return fmt.Errorf("computing content hash: %w", err)
+			return newFileError(path, StageHash, fmt.Errorf("computing content hash: %w", err))
 		}
 	}
 
-	dedupPath := filepath.Join(p.Storage.Opts.Root, finalHash)
+	// Files with the same content may be copied at the same time
+	alreadyProcessing, waitChan := dedupStartProcessing(finalHash)
+	if alreadyProcessing {
+		<-waitChan
+	}
+	defer dedupFinishProcessing(finalHash)
 
 	// Check if the deduplicated file already exists in storage
-	exists, err := p.Storage.FileExists(dedupPath)
+	dedupPath, exists, err := p.Storage.FindObject(finalHash)
+	if err != nil {
+		return newFileError(path, StageLookup, fmt.Errorf("checking file existence in storage: %w", err))
+	}
+
+	p.Stats.addScanned(info.Size())
+	p.emit(ProgressEvent{Kind: EventHashed, Worker: worker, Path: path, Size: info.Size()})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Decide what to do with an existing destination before touching the
+	// source
+	action, err := p.check(dest, dedupPath, info)
 	if err != nil {
-		return fmt.Errorf("checking file existence in storage: %w", err)
+		return newFileError(path, StageLink, fmt.Errorf("checking destination %s: %w", dest, err))
+	}
+	if action == destSkip {
+		if verbose {
+			log.Printf("Leaving existing destination: %s", dest)
+		}
+		if !p.DryRun {
+			p.Stats.addConflict(dest, false)
+		}
+		p.emit(ProgressEvent{Kind: EventSkipped, Worker: worker, Path: path, Size: info.Size()})
+		return nil
+	}
+
+	if p.DryRun {
+		if verbose {
+			log.Printf("Dry run, not touching file: %s", path)
+		}
+		if !exists {
+			p.DryRunReport.plan(path, finalHash, info.Size(), false, false)
+		}
+		// The destination is a link instead of a copy of the source
+		p.DryRunReport.plan(dest, finalHash, info.Size(), true, false)
+		p.emit(ProgressEvent{Kind: EventLinked, Worker: worker, Path: path, Size: info.Size(), Saved: info.Size()})
+		return nil
 	}
 
 	// If the file does not exist, move it to storage
@@ -77,9 +505,9 @@ func (p *CpProcessor) Process(verbose bool) (err error) {
 		if verbose {
 			log.Printf("File does not exist in storage, moving it: %s", dedupPath)
 		}
-		err = p.Storage.MoveFileToStorage(p.SourceFile, finalHash)
+		err = p.Storage.MoveFileToStorage(path, finalHash)
 		if err != nil {
-			return fmt.Errorf("moving file to storage: %w", err)
+			return newFileError(path, StageStore, fmt.Errorf("moving file to storage: %w", err))
 		}
 	} else {
 		if verbose {
@@ -88,19 +516,139 @@ func (p *CpProcessor) Process(verbose bool) (err error) {
 	}
 
 	// Create a link at the destination pointing to the file in storage,
-	// removing the destination if it already exists
-	if verbose {
-		log.Printf("Creating link at destination: %s", p.DestFile)
+	// making room for it according to the conflict policy
+	link, err := p.apply(dest, action, &p.Stats)
+	if err != nil {
+		return newFileError(path, StageLink, fmt.Errorf("making room at destination: %w", err))
 	}
-	os.Remove(p.DestFile)
-	err = os.Link(dedupPath, p.DestFile)
+	if link {
+		if verbose {
+			log.Printf("Creating link at destination: %s", dest)
+		}
+		err = p.Storage.CreateLink(dedupPath, dest)
+		if err != nil {
+			return newFileError(path, StageLink, fmt.Errorf("linking file: %w", err))
+		}
+	}
+
+	err = p.Storage.AddReference(finalHash, dest)
 	if err != nil {
-		return fmt.Errorf("linking file: %w", err)
+		return newFileError(path, StageIndex, fmt.Errorf("indexing link: %w", err))
+	}
+
+	// A moved file only saves space if it duplicates a stored one
+	if p.move {
+		if verbose {
+			log.Printf("Removing moved file: %s", path)
+		}
+		if err := p.removeSource(path, dest, finalHash); err != nil {
+			return err
+		}
+		p.Stats.addProcessed(info.Size(), exists)
+		if exists {
+			p.emit(ProgressEvent{Kind: EventLinked, Worker: worker, Path: path, Size: info.Size(), Saved: info.Size()})
+		} else {
+			p.emit(ProgressEvent{Kind: EventStored, Worker: worker, Path: path, Size: info.Size()})
+		}
+		return nil
 	}
 
+	// The destination is a link instead of a copy of the source
+	p.Stats.addCopied(info.Size(), !exists)
+	p.emit(ProgressEvent{Kind: EventLinked, Worker: worker, Path: path, Size: info.Size(), Saved: info.Size()})
+
 	if verbose {
-		log.Printf("Successfully linked file to destination: %s", p.DestFile)
+		log.Printf("Successfully linked file to destination: %s", dest)
 	}
 
 	return nil
 }
+
+// copySymlink recreates the symlink at the given path, with the same target,
+// at the destination, according to the conflict policy
+func (p *CpProcessor) copySymlink(path, dest string, info os.FileInfo) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	// A symlink with the same target is already a copy
+	if existing, err := os.Readlink(dest); err == nil && existing == target {
+		return storage.CopyAttributes(dest, info)
+	}
+
+	action, err := p.check(dest, "", info)
+	if err != nil {
+		return err
+	}
+	link, err := p.apply(dest, action, &p.Stats)
+	if !link || err != nil {
+		return err
+	}
+
+	err = os.Symlink(target, dest)
+	if err != nil {
+		return err
+	}
+
+	return storage.CopyAttributes(dest, info)
+}
+
+// removeSource removes the source of a moved file, once its destination is
+// verified to be linked to the object with the given hash
+func (p *CpProcessor) removeSource(path, dest, hash string) error {
+	destInfo, err := os.Lstat(dest)
+	if err != nil {
+		return newFileError(path, StageVerify, err)
+	}
+	if !p.Storage.IsLinked(dest, destInfo, hash) {
+		return newFileError(path, StageVerify, fmt.Errorf("destination %s is not linked to the stored file", dest))
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return newFileError(path, StageRemove, err)
+	}
+
+	err = p.Storage.RemoveReference(path)
+	if err != nil {
+		return newFileError(path, StageIndex, fmt.Errorf("forgetting moved file: %w", err))
+	}
+
+	return nil
+}
+
+// removeSymlink removes the source of a moved symlink, once its destination
+// is verified to have the same target. A destination left in place by the
+// conflict policy keeps the source too
+func removeSymlink(path, dest string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return newFileError(path, StageVerify, err)
+	}
+	if destTarget, err := os.Readlink(dest); err != nil || destTarget != target {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return newFileError(path, StageRemove, err)
+	}
+
+	return nil
+}
+
+// samePath checks if the given paths point to the same location, links to
+// the same file being different paths
+func samePath(a, b string) bool {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false
+	}
+
+	return absA == absB
+}
@@ -1,12 +1,13 @@
 package processor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/mirkobrombin/dabadee/pkg/cache"
@@ -23,15 +24,33 @@ var (
 // DedupProcessor is a processor that deduplicates files by moving them to a
 // storage and creating a link to the original location
 type DedupProcessor struct {
+	// Walker decides which files under Source are processed
+	Walker
+
+	// Events sends the progress of the run to its subscribers
+	Events
+
+	// Conflicts decides what happens to the paths that already exist in
+	// DestDir, they are left as they are by default
+	Conflicts
+
 	// Source is the path of the directory to deduplicate
 	Source string
 
+	// AdditionalSources holds more directories deduplicated in the same run.
+	// With DestDir set, each source is linked into it under its base name
+	AdditionalSources []string
+
 	// DestDir is the path of the directory to copy deduplicated files to
 	DestDir string
 
 	// Storage is the storage interface to use
 	Storage *storage.Storage
 
+	// Pool, when set, picks the storage of each file according to the
+	// device it lives on, so the source can span several filesystems
+	Pool *storage.Pool
+
 	// HashGen is the hash generator to use
 	HashGen hash.Generator
 
@@ -41,35 +60,106 @@ type DedupProcessor struct {
 	// FileMap is a map of original file paths to their hash in storage
 	FileMap map[string]string
 
+	// Metadata is a map of original file paths to the metadata they had
+	// when found
+	Metadata map[string]storage.FileMetadata
+
 	// mapMutex is a mutex to protect the FileMap from concurrent access
 	mapMutex sync.Mutex
 
 	// Cache holds information about previously processed files
 	Cache *cache.Cache
 
+	// Paranoid compares the content of each file with the stored one before
+	// replacing it, instead of trusting the hash alone
+	Paranoid bool
+
+	// DryRun makes the processor only hash the files and consult the
+	// storage, reporting in DryRunReport what would be done
+	DryRun bool
+
+	// DryRunReport holds what would be done, filled in dry-run mode
+	DryRunReport DryRunReport
+
 	// Stats holds statistics about the current run
 	Stats DedupStats
+
+	// locks holds the storage locks acquired during the run
+	locks      map[*storage.Storage]*os.File
+	locksMutex sync.Mutex
 }
 
-// DedupStats collects information about the deduplication process
-type DedupStats struct {
-	Processed int
-	Skipped   int
-	Duration  time.Duration
+// NewDedupProcessor creates a new DedupProcessor, loading the cache of the
+// storage
+func NewDedupProcessor(source, destDir string, s *storage.Storage, hashGen hash.Generator, workers int) *DedupProcessor {
+	c, _ := LoadCache(s)
+	return NewDedupProcessorWithCache(source, destDir, s, c, hashGen, workers)
 }
 
-// NewDedupProcessor creates a new DedupProcessor
-func NewDedupProcessor(source, destDir string, storage *storage.Storage, hashGen hash.Generator, workers int) *DedupProcessor {
-	cachePath := filepath.Join(storage.Opts.Root, ".dedup_cache")
-	c, _ := cache.Load(cachePath)
+// NewDedupProcessorWithCache creates a new DedupProcessor using the given
+// cache, which must be the one of the storage
+func NewDedupProcessorWithCache(source, destDir string, s *storage.Storage, c *cache.Cache, hashGen hash.Generator, workers int) *DedupProcessor {
 	return &DedupProcessor{
-		Source:  source,
-		DestDir: destDir,
-		Storage: storage,
-		HashGen: hashGen,
-		Workers: workers,
-		FileMap: make(map[string]string),
-		Cache:   c,
+		Source:   source,
+		DestDir:  destDir,
+		Storage:  s,
+		HashGen:  hashGen,
+		Workers:  workers,
+		FileMap:  make(map[string]string),
+		Metadata: make(map[string]storage.FileMetadata),
+		Cache:    c,
+		Conflicts: Conflicts{
+			OnConflict: ConflictNoClobber,
+		},
+	}
+}
+
+// LoadCache loads the cache of the files deduplicated with the given storage
+func LoadCache(s *storage.Storage) (*cache.Cache, error) {
+	return cache.Load(filepath.Join(s.Opts.Root, ".dedup_cache"))
+}
+
+// Manifest returns the manifest of the processed files, with their hash and
+// the metadata they had when found
+func (p *DedupProcessor) Manifest() storage.Manifest {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+
+	manifest := make(storage.Manifest, len(p.FileMap))
+	for path, hash := range p.FileMap {
+		entry := storage.ManifestEntry{Hash: hash}
+		if metadata, ok := p.Metadata[path]; ok {
+			entry.Metadata = &metadata
+		}
+		manifest[path] = entry
+	}
+
+	return manifest
+}
+
+// resolveCollision looks for the stored object with the same hash and content
+// of the file at the given path, trying the disambiguated names given to the
+// colliding ones. If none matches, the first free name is returned
+func (p *DedupProcessor) resolveCollision(s *storage.Storage, path, hash string, verbose bool) (name, objectPath string, exists bool, err error) {
+	name = hash
+	for n := 1; ; n++ {
+		objectPath, exists, err = s.FindObject(name)
+		if err != nil || !exists {
+			return name, objectPath, exists, err
+		}
+
+		same, err := storage.SameContent(path, objectPath)
+		if err != nil || same {
+			return name, objectPath, exists, err
+		}
+
+		if n == 1 {
+			if verbose {
+				log.Printf("Hash collision for file %s", path)
+			}
+			p.Stats.addCollision(path)
+		}
+		name = storage.CollisionName(hash, n)
 	}
 }
 
@@ -108,17 +198,188 @@ func dedupFinishProcessing(hash string) {
 	}
 }
 
-// Process processes the files in the source directory
-func (p *DedupProcessor) Process(verbose bool) error {
-	lockFile, err := p.Storage.AcquireLock()
+// storageFor returns the storage to use for the given path, in pool mode its
+// lock is acquired the first time it is used
+func (p *DedupProcessor) storageFor(path string) (*storage.Storage, error) {
+	if p.Pool == nil {
+		return p.Storage, nil
+	}
+
+	s, err := p.Pool.ForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.lockStorage(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lockStorage acquires the lock of the given storage, if not already held
+func (p *DedupProcessor) lockStorage(s *storage.Storage) error {
+	p.locksMutex.Lock()
+	defer p.locksMutex.Unlock()
+
+	if _, ok := p.locks[s]; ok {
+		return nil
+	}
+
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return err
+	}
+
+	p.locks[s] = lockFile
+	return nil
+}
+
+// releaseLocks releases the storage locks acquired during the run
+func (p *DedupProcessor) releaseLocks() {
+	p.locksMutex.Lock()
+	defer p.locksMutex.Unlock()
+
+	for s, lockFile := range p.locks {
+		s.ReleaseLock(lockFile)
+	}
+	p.locks = nil
+}
+
+// Process processes the files in the source directories. Once the context is
+// cancelled no more files are processed, the ones in progress are completed
+// and the cache and index are saved, so that running again resumes the work.
+// If some files cannot be processed a PartialError listing them is returned
+func (p *DedupProcessor) Process(ctx context.Context, verbose bool) error {
+	return p.run(ctx, verbose, func(ctx context.Context, jobs chan<- dedupJob) error {
+		p.Stats.WalkStats = WalkStats{Ignored: make(map[string]string)}
+		for _, root := range p.sources() {
+			var stats WalkStats
+			err := p.Walk(ctx, root, verbose, &stats, func(path string, info os.FileInfo) error {
+				if verbose {
+					log.Printf("Adding file to job queue: %s", path)
+				}
+				return p.enqueue(ctx, jobs, root, path, info)
+			})
+			p.Stats.WalkStats.merge(stats)
+			if err != nil {
+				return err
+			}
+		}
+		p.emit(ProgressEvent{Kind: EventWalkDone})
+		return nil
+	})
+}
+
+// sources returns Source and AdditionalSources
+func (p *DedupProcessor) sources() []string {
+	return append([]string{p.Source}, p.AdditionalSources...)
+}
+
+// checkSources fails if several sources would be linked into DestDir under
+// the same base name, merging their trees
+func (p *DedupProcessor) checkSources() error {
+	if p.DestDir == "" || len(p.AdditionalSources) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]string)
+	for _, source := range p.sources() {
+		name := filepath.Base(filepath.Clean(source))
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("sources %s and %s would both be linked to %s", other, source, filepath.Join(p.DestDir, name))
+		}
+		seen[name] = source
+	}
+	return nil
+}
+
+// destPath returns the path in DestDir of the given file found under root
+func (p *DedupProcessor) destPath(root, path string) (string, error) {
+	relativePath, err := filepath.Rel(root, path)
 	if err != nil {
+		return "", err
+	}
+
+	if len(p.AdditionalSources) > 0 {
+		return filepath.Join(p.DestDir, filepath.Base(root), relativePath), nil
+	}
+	return filepath.Join(p.DestDir, relativePath), nil
+}
+
+// ProcessFiles processes the given files, which must live under Source, like
+// Process does for the files found walking it. No filtering is applied
+func (p *DedupProcessor) ProcessFiles(ctx context.Context, paths []string, verbose bool) error {
+	return p.run(ctx, verbose, func(ctx context.Context, jobs chan<- dedupJob) error {
+		p.Stats.WalkStats = WalkStats{}
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err != nil {
+				p.addFailure(path, newFileError(path, StageStat, err))
+				continue
+			}
+			if err := p.enqueue(ctx, jobs, p.Source, path, info); err != nil {
+				return err
+			}
+		}
+		p.emit(ProgressEvent{Kind: EventWalkDone})
+		return nil
+	})
+}
+
+// enqueue sends a file found under root to the workers
+func (p *DedupProcessor) enqueue(ctx context.Context, jobs chan<- dedupJob, root, path string, info os.FileInfo) error {
+	p.emit(ProgressEvent{Kind: EventDiscovered, Path: path, Size: info.Size()})
+	select {
+	case jobs <- dedupJob{root: root, path: path, size: info.Size()}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run processes the files sent by feed with the workers, holding the storage
+// locks for the whole run
+func (p *DedupProcessor) run(ctx context.Context, verbose bool, feed func(ctx context.Context, jobs chan<- dedupJob) error) error {
+	if _, err := ParseConflictPolicy(string(p.OnConflict)); err != nil {
+		return err
+	}
+	if err := p.checkSources(); err != nil {
 		return err
 	}
-	defer p.Storage.ReleaseLock(lockFile)
+
+	p.locks = make(map[*storage.Storage]*os.File)
+	defer p.releaseLocks()
+
+	if p.Pool == nil {
+		// Renames and hardlinks cannot cross filesystems, fail before
+		// touching anything if the sources are not on the storage device,
+		// unless symlinks are used
+		for _, source := range p.sources() {
+			err := p.Storage.CheckLinkable(source, p.DestDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := p.lockStorage(p.Storage)
+		if err != nil {
+			return err
+		}
+
+		// Other processes may have saved the cache while it was open
+		err = p.Cache.Reload()
+		if err != nil {
+			return fmt.Errorf("reloading cache: %w", err)
+		}
+	} else if p.DestDir != "" {
+		return fmt.Errorf("a destination directory is not supported in pool mode")
+	}
 
 	start := time.Now()
 
-	if p.DestDir != "" {
+	if p.DestDir != "" && !p.DryRun {
 		if verbose {
 			log.Printf("Creating destination directory: %s", p.DestDir)
 		}
@@ -128,97 +389,134 @@ func (p *DedupProcessor) Process(verbose bool) error {
 		}
 	}
 
-	jobs := make(chan string, p.Workers)
+	// In fail-fast mode the first failure stops the run as a cancellation
+	// would
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.Stats.reset(p.Workers)
+
+	jobs := make(chan dedupJob, p.Workers)
 	var wg sync.WaitGroup
 
 	// Start workers
 	for i := 0; i < p.Workers; i++ {
 		wg.Add(1)
-		go func() {
+		go func(worker int) {
 			defer wg.Done()
-			for path := range jobs {
-				err := p.processFile(path, verbose)
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				p.emit(ProgressEvent{Kind: EventStarted, Worker: worker, Path: job.path, Size: job.size})
+				jobStart := time.Now()
+				err := p.processFile(worker, job.root, job.path, verbose)
+				p.Stats.addWork(worker, job.size, time.Since(jobStart))
 				if err != nil {
 					if verbose {
-						log.Printf("Error processing file %s: %v", path, err)
+						log.Printf("Error processing file %s: %v", job.path, err)
+					}
+					p.emit(ProgressEvent{Kind: EventFailed, Worker: worker, Path: job.path, Size: job.size, Err: err})
+					p.addFailure(job.path, err)
+					if p.FailFast {
+						cancel()
 					}
 				}
 			}
-		}()
+		}(i)
 	}
 
-	// Walk the source directory to enqueue jobs
-	err = filepath.Walk(p.Source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			if verbose {
-				log.Printf("Error accessing path %s: %v", path, err)
-			}
-			return filepath.SkipDir
-		}
-
-		if !info.IsDir() && path != p.Storage.Opts.Root {
-			// Check if we have permission to read the file
-			file, err := os.Open(path)
-			if err != nil {
-				if verbose {
-					log.Printf("Skipping file %s due to permissions: %v", path, err)
-				}
-				return nil
-			}
-			file.Close()
-
-			if verbose {
-				log.Printf("Adding file to job queue: %s", path)
-			}
-			jobs <- path
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
+	// Feed the workers
+	err := feed(ctx, jobs)
 	close(jobs)
 	wg.Wait()
-	p.Stats.Duration = time.Since(start)
+	// Stopped by a failure, which is already recorded
+	var fileErr *FileError
+	if errors.As(err, &fileErr) || errors.Is(err, context.Canceled) && parent.Err() == nil {
+		err = nil
+	}
+	p.Stats.finish(time.Since(start))
+	if err == nil && len(p.Stats.Failures) > 0 {
+		err = &PartialError{Errors: p.Stats.Failures}
+	}
 	if verbose {
 		log.Printf("Processed: %d, Skipped: %d, Duration: %s", p.Stats.Processed, p.Stats.Skipped, p.Stats.Duration)
 	}
+	if p.DryRun {
+		return err
+	}
+
+	// Save what is known about the completed files, even if the walk
+	// failed or was interrupted
 	if p.Cache != nil {
 		if err := p.Cache.Save(); err != nil && verbose {
 			log.Printf("Error saving cache: %v", err)
 		}
 	}
-	return nil
+	storages := []*storage.Storage{p.Storage}
+	if p.Pool != nil {
+		storages = p.Pool.Storages()
+	}
+	for _, s := range storages {
+		if err := s.SaveIndex(); err != nil {
+			return fmt.Errorf("saving index: %w", err)
+		}
+	}
+	return err
+}
+
+// addFailure records a file that could not be processed
+func (p *DedupProcessor) addFailure(path string, err error) {
+	p.Stats.addFailure(asFileError(path, err))
 }
 
-func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
+// dedupJob is a file found by the walker, waiting to be processed
+type dedupJob struct {
+	root string
+	path string
+	size int64
+}
+
+func (p *DedupProcessor) processFile(worker int, root, path string, verbose bool) (err error) {
 	if verbose {
 		log.Printf("Processing file: %s", path)
 	}
 
 	info, err := os.Lstat(path)
 	if err != nil {
-		return err
+		return newFileError(path, StageStat, err)
+	}
+
+	s, err := p.storageFor(path)
+	if err != nil {
+		return newFileError(path, StageStorage, fmt.Errorf("getting storage: %w", err))
+	}
+
+	// Symlinks are left alone, unless linking to the storage, as it is their
+	// target that would be stored
+	if info.Mode()&os.ModeSymlink != 0 && !s.IsStorageLink(path) {
+		if verbose {
+			log.Printf("Skipping symlink: %s", path)
+		}
+		p.emit(ProgressEvent{Kind: EventSkipped, Worker: worker, Path: path, Size: info.Size()})
+		return nil
 	}
 
 	// Check cache for unchanged files
 	if entry, ok := p.Cache.Get(path); ok {
 		if entry.ModTime == info.ModTime().Unix() && entry.Size == info.Size() {
-			dedupPath := filepath.Join(p.Storage.Opts.Root, entry.Hash)
-			storedInfo, sErr := os.Lstat(dedupPath)
-			if sErr == nil {
-				if statOrig, ok1 := info.Sys().(*syscall.Stat_t); ok1 {
-					if statStored, ok2 := storedInfo.Sys().(*syscall.Stat_t); ok2 && statOrig.Ino == statStored.Ino {
-						if verbose {
-							log.Printf("Skipping unchanged file: %s", path)
-						}
-						p.mapMutex.Lock()
-						p.FileMap[path] = entry.Hash
-						p.mapMutex.Unlock()
-						p.Stats.Skipped++
-						return nil
-					}
+			linked := s.IsLinked(path, info, entry.Hash)
+			p.Stats.addCacheHit(linked)
+			if linked {
+				if verbose {
+					log.Printf("Skipping unchanged file: %s", path)
 				}
+				p.mapMutex.Lock()
+				p.FileMap[path] = entry.Hash
+				p.Metadata[path] = storage.NewFileMetadata(info)
+				p.mapMutex.Unlock()
+				p.emit(ProgressEvent{Kind: EventSkipped, Worker: worker, Path: path, Size: info.Size()})
+				return nil
 			}
 		}
 	}
@@ -226,13 +524,13 @@ func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
 	// Compute file hash
 	var finalHash string
 
-	if p.Storage.Opts.WithMetadata {
+	if s.Opts.WithMetadata {
 		if verbose {
 			log.Println("Computing full hash with metadata")
 		}
 		finalHash, err = p.HashGen.ComputeFullHash(path)
 		if err != nil {
-			return fmt.Errorf("computing full hash: %w", err)
+			return newFileError(path, StageHash, fmt.Errorf("computing full hash: %w", err))
 		}
 	} else {
 		if verbose {
@@ -240,9 +538,11 @@ func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
 		}
 		finalHash, err = p.HashGen.ComputeFileHash(path)
 		if err != nil {
-			return fmt.Errorf("computing content hash: %w", err)
+			return newFileError(path, StageHash, fmt.Errorf("computing content hash: %w", err))
 		}
 	}
+	p.Stats.addScanned(info.Size())
+	p.emit(ProgressEvent{Kind: EventHashed, Worker: worker, Path: path, Size: info.Size()})
 
 	// Check if the file is already being processed
 	alreadyProcessing, waitChan := dedupStartProcessing(finalHash)
@@ -254,38 +554,94 @@ func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
 	}
 
 	// Check if a file with the same hash already exists in storage
-	dedupPath := filepath.Join(p.Storage.Opts.Root, finalHash)
-	exists, err := p.Storage.FileExists(dedupPath)
+	dedupPath, exists, err := s.FindObject(finalHash)
 	if err != nil {
 		dedupFinishProcessing(finalHash)
-		return fmt.Errorf("checking file existence in storage: %w", err)
+		return newFileError(path, StageLookup, fmt.Errorf("checking file existence in storage: %w", err))
 	}
 
-	if !exists {
+	// In paranoid mode the hash alone is not trusted, the object with the
+	// same content is looked up among the ones sharing the hash
+	objectName := finalHash
+	if exists && p.Paranoid {
+		objectName, dedupPath, exists, err = p.resolveCollision(s, path, finalHash, verbose)
+		if err != nil {
+			dedupFinishProcessing(finalHash)
+			return newFileError(path, StageCompare, fmt.Errorf("comparing with stored file: %w", err))
+		}
+	}
+
+	// A file linked to the object already, e.g. when the cache was lost, is
+	// left as it is
+	alreadyLinked := exists && s.IsLinked(path, info, objectName)
+
+	// Decide what to do with an existing destination before touching the
+	// source
+	var destPath string
+	var action conflictAction
+	if p.DestDir != "" {
+		destPath, err = p.destPath(root, path)
+		if err != nil {
+			dedupFinishProcessing(finalHash)
+			return newFileError(path, StageLink, fmt.Errorf("getting relative path: %w", err))
+		}
+
+		action, err = p.check(destPath, dedupPath, info)
+		if err != nil {
+			dedupFinishProcessing(finalHash)
+			return newFileError(path, StageLink, fmt.Errorf("checking destination %s: %w", destPath, err))
+		}
+	}
+
+	if p.DryRun {
+		if verbose {
+			log.Printf("Dry run, not touching file: %s", path)
+		}
+		linked := p.DryRunReport.plan(path, objectName, info.Size(), exists, alreadyLinked)
+		p.mapMutex.Lock()
+		p.FileMap[path] = objectName
+		p.Metadata[path] = storage.NewFileMetadata(info)
+		p.mapMutex.Unlock()
+		dedupFinishProcessing(finalHash)
+		if alreadyLinked {
+			p.emit(ProgressEvent{Kind: EventSkipped, Worker: worker, Path: path, Size: info.Size()})
+			return nil
+		}
+		p.emitDone(worker, path, info.Size(), linked)
+		return nil
+	}
+
+	if alreadyLinked {
+		if verbose {
+			log.Printf("File already linked to storage: %s", dedupPath)
+		}
+	} else if !exists {
 		if verbose {
 			log.Printf("File does not exist in storage, moving it: %s", dedupPath)
 		}
 		// If the file does not exist in storage, move it there
-		err = p.Storage.MoveFileToStorage(path, finalHash)
+		err = s.MoveFileToStorage(path, objectName)
 		if err != nil {
 			dedupFinishProcessing(finalHash)
-			return fmt.Errorf("moving file to storage: %w", err)
+			return newFileError(path, StageStore, fmt.Errorf("moving file to storage: %w", err))
 		}
 	} else {
 		if verbose {
 			log.Printf("File already exists in storage: %s", dedupPath)
 		}
-		// If the file already exists in storage, remove the source file
-		err = os.Remove(path)
+		// If the file already exists in storage, replace the source file
+		// with a link to it
+		err = s.ReplaceFile(path, objectName)
 		if err != nil {
 			dedupFinishProcessing(finalHash)
-			return fmt.Errorf("removing source file: %w", err)
+			return newFileError(path, StageReplace, fmt.Errorf("replacing source file: %w", err))
 		}
 	}
 
 	// Store the original path of the file
 	p.mapMutex.Lock()
-	p.FileMap[path] = finalHash
+	p.FileMap[path] = objectName
+	p.Metadata[path] = storage.NewFileMetadata(info)
 	p.mapMutex.Unlock()
 
 	// Create a link at the original location
@@ -293,30 +649,48 @@ func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
 		log.Printf("Creating link at original location: %s", path)
 	}
 	if _, err := os.Lstat(path); os.IsNotExist(err) {
-		err = os.Link(dedupPath, path)
+		err = s.CreateLink(dedupPath, path)
 		if err != nil {
 			dedupFinishProcessing(finalHash)
-			return fmt.Errorf("creating link to deduplicated file: %w", err)
+			return newFileError(path, StageLink, fmt.Errorf("creating link to deduplicated file: %w", err))
 		}
 	}
+	err = s.AddReference(objectName, path)
+	if err != nil {
+		dedupFinishProcessing(finalHash)
+		return newFileError(path, StageIndex, fmt.Errorf("indexing link to deduplicated file: %w", err))
+	}
 
 	// Create a link at the destination if DestDir is set
 	if p.DestDir != "" {
-		relativePath, err := filepath.Rel(p.Source, path)
+		link, err := p.apply(destPath, action, &p.Stats)
 		if err != nil {
 			dedupFinishProcessing(finalHash)
-			return fmt.Errorf("getting relative path: %w", err)
+			return newFileError(path, StageLink, fmt.Errorf("making room at destination: %w", err))
 		}
-
-		destPath := filepath.Join(p.DestDir, relativePath)
-		if verbose {
-			log.Printf("Creating link at destination: %s", destPath)
+		if action == destSkip && verbose {
+			log.Printf("Leaving existing destination: %s", destPath)
+		}
+		if link {
+			if verbose {
+				log.Printf("Creating link at destination: %s", destPath)
+			}
+			err = os.MkdirAll(filepath.Dir(destPath), 0755)
+			if err != nil {
+				dedupFinishProcessing(finalHash)
+				return newFileError(path, StageLink, fmt.Errorf("creating destination directory: %w", err))
+			}
+			err = s.CreateLink(dedupPath, destPath)
+			if err != nil {
+				dedupFinishProcessing(finalHash)
+				return newFileError(path, StageLink, fmt.Errorf("creating link to deduplicated file in destination: %w", err))
+			}
 		}
-		if _, err := os.Lstat(destPath); os.IsNotExist(err) {
-			err = os.Link(dedupPath, destPath)
+		if action != destSkip {
+			err = s.AddReference(objectName, destPath)
 			if err != nil {
 				dedupFinishProcessing(finalHash)
-				return fmt.Errorf("creating link to deduplicated file in destination: %w", err)
+				return newFileError(path, StageIndex, fmt.Errorf("indexing link to deduplicated file in destination: %w", err))
 			}
 		}
 	}
@@ -327,13 +701,29 @@ func (p *DedupProcessor) processFile(path string, verbose bool) (err error) {
 		p.Cache.Update(path, cache.CacheEntry{
 			ModTime: info.ModTime().Unix(),
 			Size:    info.Size(),
-			Hash:    finalHash,
+			Hash:    objectName,
 		})
 	}
-	p.Stats.Processed++
+	if alreadyLinked {
+		p.Stats.addAlreadyLinked()
+		p.emit(ProgressEvent{Kind: EventSkipped, Worker: worker, Path: path, Size: info.Size()})
+	} else {
+		p.Stats.addProcessed(info.Size(), exists)
+		p.emitDone(worker, path, info.Size(), exists)
+	}
 
 	if verbose {
 		log.Printf("Finished processing file: %s", path)
 	}
 	return nil
 }
+
+// emitDone sends the event for a processed file, either linked to an existing
+// object or stored as a new one
+func (p *DedupProcessor) emitDone(worker int, path string, size int64, linked bool) {
+	if linked {
+		p.emit(ProgressEvent{Kind: EventLinked, Worker: worker, Path: path, Size: size, Saved: size})
+		return
+	}
+	p.emit(ProgressEvent{Kind: EventStored, Worker: worker, Path: path, Size: size})
+}
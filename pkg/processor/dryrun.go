@@ -0,0 +1,55 @@
+package processor
+
+import "sync"
+
+// DryRunReport describes what a run would do, it is filled instead of
+// touching the filesystem when running in dry-run mode
+type DryRunReport struct {
+	// Moved holds the files that would be moved to the storage
+	Moved []string `json:"moved"`
+
+	// Linked holds the paths that would become links to an object
+	Linked []string `json:"linked"`
+
+	// AlreadyLinked holds the paths linked to their object already, which
+	// would be left as they are
+	AlreadyLinked []string `json:"already_linked"`
+
+	// ReclaimableBytes is the space that would be saved by linking
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+
+	// NewObjects is the number of objects that would be created
+	NewObjects int `json:"new_objects"`
+
+	mu      sync.Mutex
+	planned map[string]bool
+}
+
+// plan records what would happen to the file at the given path, found to
+// have the given object name, returning true if it would be linked. Objects
+// planned earlier in the same run count as existing ones, while paths linked
+// to their object already reclaim nothing
+func (r *DryRunReport) plan(path, name string, size int64, exists, linked bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.planned == nil {
+		r.planned = make(map[string]bool)
+	}
+
+	if linked {
+		r.AlreadyLinked = append(r.AlreadyLinked, path)
+		return false
+	}
+
+	if exists || r.planned[name] {
+		r.Linked = append(r.Linked, path)
+		r.ReclaimableBytes += size
+		return true
+	}
+
+	r.planned[name] = true
+	r.NewObjects++
+	r.Moved = append(r.Moved, path)
+	return false
+}
@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Stage is the step of the processing of a file
+type Stage string
+
+const (
+	StageWalk    Stage = "walk"
+	StageOpen    Stage = "open"
+	StageStat    Stage = "stat"
+	StageStorage Stage = "storage"
+	StageHash    Stage = "hash"
+	StageLookup  Stage = "lookup"
+	StageCompare Stage = "compare"
+	StageStore   Stage = "store"
+	StageReplace Stage = "replace"
+	StageLink    Stage = "link"
+	StageIndex   Stage = "index"
+	StageCopy    Stage = "copy"
+	StageVerify  Stage = "verify"
+	StageRemove  Stage = "remove"
+)
+
+// FileError is the failure of a single file at a given stage
+type FileError struct {
+	Path  string
+	Stage Stage
+	Err   error
+}
+
+// newFileError wraps the given error, nil stays nil
+func newFileError(path string, stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FileError{Path: path, Stage: stage, Err: err}
+}
+
+// asFileError returns the FileError wrapped by err, or wraps err as a failure
+// of the given path at no particular stage
+func asFileError(path string, err error) *FileError {
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) {
+		fileErr = &FileError{Path: path, Err: err}
+	}
+	return fileErr
+}
+
+// isInterruption checks if err is the context being cancelled or reaching its
+// deadline, which stops the run rather than failing a file
+func isInterruption(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && errors.Is(err, ctx.Err())
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Stage, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Errno returns the system error behind the failure, if any
+func (e *FileError) Errno() (syscall.Errno, bool) {
+	var errno syscall.Errno
+	ok := errors.As(e.Err, &errno)
+	return errno, ok
+}
+
+// MarshalJSON encodes the error with its message and errno
+func (e *FileError) MarshalJSON() ([]byte, error) {
+	entry := struct {
+		Path  string `json:"path"`
+		Stage Stage  `json:"stage"`
+		Error string `json:"error"`
+		Errno int    `json:"errno,omitempty"`
+	}{Path: e.Path, Stage: e.Stage, Error: e.Err.Error()}
+	if errno, ok := e.Errno(); ok {
+		entry.Errno = int(errno)
+	}
+
+	return json.Marshal(entry)
+}
+
+// UnmarshalJSON decodes an error encoded by MarshalJSON, the message and
+// errno are kept
+func (e *FileError) UnmarshalJSON(data []byte) error {
+	var entry struct {
+		Path  string `json:"path"`
+		Stage Stage  `json:"stage"`
+		Error string `json:"error"`
+		Errno int    `json:"errno"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+
+	e.Path = entry.Path
+	e.Stage = entry.Stage
+	e.Err = &decodedError{msg: entry.Error, errno: syscall.Errno(entry.Errno)}
+	return nil
+}
+
+// decodedError is an error decoded from JSON, unwrapping to its errno if any
+type decodedError struct {
+	msg   string
+	errno syscall.Errno
+}
+
+func (e *decodedError) Error() string {
+	return e.msg
+}
+
+func (e *decodedError) Unwrap() error {
+	if e.errno == 0 {
+		return nil
+	}
+	return e.errno
+}
+
+// PartialError is returned when the run completed but some files could not
+// be processed
+type PartialError struct {
+	Errors []*FileError
+}
+
+func (e *PartialError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	return fmt.Sprintf("%d files failed, first: %v", len(e.Errors), e.Errors[0])
+}
+
+func (e *PartialError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Filter decides if the file at the given path is a candidate for
+// deduplication, info is the result of Lstat
+type Filter func(path string, info os.FileInfo) bool
+
+// MinSize accepts files of at least the given size in bytes
+func MinSize(size int64) Filter {
+	return func(path string, info os.FileInfo) bool {
+		return info.Size() >= size
+	}
+}
+
+// MaxSize accepts files of at most the given size in bytes
+func MaxSize(size int64) Filter {
+	return func(path string, info os.FileInfo) bool {
+		return info.Size() <= size
+	}
+}
+
+// OlderThan accepts files not modified within the given duration
+func OlderThan(age time.Duration) Filter {
+	return func(path string, info os.FileInfo) bool {
+		return time.Since(info.ModTime()) >= age
+	}
+}
+
+// RegularOnly accepts regular files only, skipping symlinks and special files
+func RegularOnly(path string, info os.FileInfo) bool {
+	return info.Mode().IsRegular()
+}
+
+// NoSetuid skips files with the setuid or setgid bit set
+func NoSetuid(path string, info os.FileInfo) bool {
+	return info.Mode()&(os.ModeSetuid|os.ModeSetgid) == 0
+}
+
+// NoExecutable skips files executable by anyone
+func NoExecutable(path string, info os.FileInfo) bool {
+	return info.Mode().Perm()&0111 == 0
+}
+
+// TypeFilter returns the filter with the given name, one of regular,
+// no-setuid and no-exec
+func TypeFilter(name string) (Filter, error) {
+	switch name {
+	case "regular":
+		return RegularOnly, nil
+	case "no-setuid":
+		return NoSetuid, nil
+	case "no-exec":
+		return NoExecutable, nil
+	default:
+		return nil, fmt.Errorf("unknown file type filter %q", name)
+	}
+}
@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+)
+
+// FindDupesProcessor is a processor that finds the files with the same
+// content under some paths, without touching them nor needing a storage.
+// Files are grouped by size first, so only the ones sharing their size with
+// another are hashed
+type FindDupesProcessor struct {
+	// Walker decides which files under Paths are considered
+	Walker
+
+	// Paths holds the directories and files to look into
+	Paths []string
+
+	// HashGen is the hash generator to use
+	HashGen hash.Generator
+
+	// Workers is the number of files hashed at the same time
+	Workers int
+
+	// Groups holds the duplicates found, the groups wasting the most space
+	// first
+	Groups []DupeGroup
+
+	// Stats holds statistics about the walk of every path
+	Stats WalkStats
+}
+
+// DupeGroup is a set of files with the same content
+type DupeGroup struct {
+	// Hash is the hash of the content
+	Hash string `json:"hash"`
+
+	// Size is the size of each file in bytes
+	Size int64 `json:"size"`
+
+	// Paths holds the files, sorted. Hardlinks of the same file are all
+	// listed but count once
+	Paths []string `json:"paths"`
+
+	// Wasted is the space that linking the files would save
+	Wasted int64 `json:"wasted"`
+}
+
+// dupeCandidate is a file that may have duplicates, with the other paths
+// of its inode
+type dupeCandidate struct {
+	paths []string
+	size  int64
+	hash  string
+}
+
+// NewFindDupesProcessor creates a new FindDupesProcessor
+func NewFindDupesProcessor(paths []string, hashGen hash.Generator, workers int) *FindDupesProcessor {
+	return &FindDupesProcessor{
+		Paths:   paths,
+		HashGen: hashGen,
+		Workers: workers,
+	}
+}
+
+// Wasted returns the space wasted by all the duplicates found
+func (p *FindDupesProcessor) Wasted() int64 {
+	var wasted int64
+	for _, group := range p.Groups {
+		wasted += group.Wasted
+	}
+	return wasted
+}
+
+// Process walks the paths and fills Groups. If some files cannot be read a
+// PartialError listing them is returned, the groups are still filled
+func (p *FindDupesProcessor) Process(ctx context.Context, verbose bool) error {
+	p.Groups = nil
+	p.Stats = WalkStats{Ignored: make(map[string]string)}
+
+	// Group the files by size, hardlinks of the same inode being a single
+	// candidate
+	bySize := make(map[int64][]*dupeCandidate)
+	byInode := make(map[[2]uint64]*dupeCandidate)
+	for _, root := range p.Paths {
+		var stats WalkStats
+		err := p.Walk(ctx, root, verbose, &stats, func(path string, info os.FileInfo) error {
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				key := [2]uint64{uint64(stat.Dev), stat.Ino}
+				if candidate, ok := byInode[key]; ok {
+					// Overlapping paths find the same files again
+					for _, known := range candidate.paths {
+						if known == path {
+							return nil
+						}
+					}
+					candidate.paths = append(candidate.paths, path)
+					return nil
+				}
+				candidate := &dupeCandidate{paths: []string{path}, size: info.Size()}
+				byInode[key] = candidate
+				bySize[info.Size()] = append(bySize[info.Size()], candidate)
+				return nil
+			}
+
+			bySize[info.Size()] = append(bySize[info.Size()], &dupeCandidate{paths: []string{path}, size: info.Size()})
+			return nil
+		})
+		p.Stats.merge(stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hash the files sharing their size with another
+	var candidates []*dupeCandidate
+	for _, sized := range bySize {
+		if len(sized) > 1 {
+			candidates = append(candidates, sized...)
+		}
+	}
+	if err := p.hash(ctx, candidates, verbose); err != nil {
+		return err
+	}
+
+	byHash := make(map[string][]*dupeCandidate)
+	for _, candidate := range candidates {
+		if candidate.hash != "" {
+			byHash[candidate.hash] = append(byHash[candidate.hash], candidate)
+		}
+	}
+	for hash, same := range byHash {
+		if len(same) < 2 {
+			continue
+		}
+
+		group := DupeGroup{Hash: hash, Size: same[0].size, Wasted: same[0].size * int64(len(same)-1)}
+		for _, candidate := range same {
+			group.Paths = append(group.Paths, candidate.paths...)
+		}
+		sort.Strings(group.Paths)
+		p.Groups = append(p.Groups, group)
+	}
+	sort.Slice(p.Groups, func(i, j int) bool {
+		if p.Groups[i].Wasted != p.Groups[j].Wasted {
+			return p.Groups[i].Wasted > p.Groups[j].Wasted
+		}
+		return p.Groups[i].Paths[0] < p.Groups[j].Paths[0]
+	})
+
+	if len(p.Stats.Errors) > 0 {
+		return &PartialError{Errors: p.Stats.Errors}
+	}
+	return nil
+}
+
+// hash computes the hash of the given candidates with the workers, the ones
+// that cannot be read are recorded as failures and left without hash
+func (p *FindDupesProcessor) hash(ctx context.Context, candidates []*dupeCandidate, verbose bool) error {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// In fail-fast mode the first failure stops the feeding of the workers
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan *dupeCandidate)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for candidate := range jobs {
+				path := candidate.paths[0]
+				if verbose {
+					log.Printf("Hashing file: %s", path)
+				}
+
+				hash, err := p.HashGen.ComputeFileHash(path)
+				if err != nil {
+					mu.Lock()
+					p.Stats.Errors = append(p.Stats.Errors, &FileError{Path: path, Stage: StageHash, Err: err})
+					mu.Unlock()
+					if p.FailFast {
+						cancel()
+					}
+					continue
+				}
+				candidate.hash = hash
+			}
+		}()
+	}
+
+feed:
+	for _, candidate := range candidates {
+		select {
+		case jobs <- candidate:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	if p.FailFast && len(p.Stats.Errors) > 0 {
+		return p.Stats.Errors[0]
+	}
+	return nil
+}
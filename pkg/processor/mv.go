@@ -0,0 +1,22 @@
+package processor
+
+import (
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+)
+
+// MvProcessor is a processor that moves a file or a directory tree through
+// the storage. Each file is copied like CpProcessor does, then its source is
+// removed once the destination is verified to be linked to the stored file.
+// Directories are removed once empty, so the files skipped by the walker or
+// the conflict policy and the failed ones are left in the source
+type MvProcessor struct {
+	*CpProcessor
+}
+
+// NewMvProcessor creates a new MvProcessor
+func NewMvProcessor(source, dest string, storage *storage.Storage, hashGen hash.Generator) *MvProcessor {
+	p := NewCpProcessor(source, dest, storage, hashGen)
+	p.move = true
+	return &MvProcessor{CpProcessor: p}
+}
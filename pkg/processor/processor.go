@@ -1,7 +1,9 @@
 package processor
 
+import "context"
+
 // Processor defines the core processing logic, implement this to add new
 // functionalities that can be orchestrated by DaBaDee
 type Processor interface {
-	Process(verbose bool) error
+	Process(ctx context.Context, verbose bool) error
 }
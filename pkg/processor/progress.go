@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressEventKind is the kind of a ProgressEvent
+type ProgressEventKind string
+
+const (
+	// EventDiscovered is sent when the walker finds a file to process
+	EventDiscovered ProgressEventKind = "discovered"
+
+	// EventWalkDone is sent when the walker has found every file, so the
+	// totals are known
+	EventWalkDone ProgressEventKind = "walk-done"
+
+	// EventStarted is sent when a worker starts processing a file
+	EventStarted ProgressEventKind = "started"
+
+	// EventHashed is sent when the hash of a file has been computed
+	EventHashed ProgressEventKind = "hashed"
+
+	// EventSkipped is sent when a file is skipped as unchanged since the
+	// last run
+	EventSkipped ProgressEventKind = "skipped"
+
+	// EventStored is sent when a file has been moved to the storage as a
+	// new object
+	EventStored ProgressEventKind = "stored"
+
+	// EventLinked is sent when a file has been replaced by a link to an
+	// existing object
+	EventLinked ProgressEventKind = "linked"
+
+	// EventFailed is sent when a file could not be processed
+	EventFailed ProgressEventKind = "failed"
+)
+
+// ProgressEvent describes a step of a run
+type ProgressEvent struct {
+	Kind ProgressEventKind
+
+	// Worker is the worker handling the file, for the events sent by the
+	// workers
+	Worker int
+
+	// Path is the file the event refers to
+	Path string
+
+	// Size is the size of the file in bytes
+	Size int64
+
+	// Saved is the space saved by linking the file, in bytes
+	Saved int64
+
+	// Err is the reason of the failure, for EventFailed
+	Err error
+}
+
+// Events holds the subscribers to the progress events of a processor
+type Events struct {
+	mu          sync.RWMutex
+	subscribers []func(ProgressEvent)
+}
+
+// Subscribe registers a function called for every progress event. It is
+// called from the walker and the workers concurrently, so it must be safe for
+// concurrent use and return quickly
+func (e *Events) Subscribe(fn func(ProgressEvent)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.subscribers = append(e.subscribers, fn)
+}
+
+// emit sends the event to every subscriber
+func (e *Events) emit(event ProgressEvent) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, fn := range e.subscribers {
+		fn(event)
+	}
+}
+
+// Progress aggregates the progress events of a run, subscribe its Handle
+// method to a processor and read the totals with Snapshot
+type Progress struct {
+	mu       sync.Mutex
+	snapshot ProgressSnapshot
+}
+
+// ProgressSnapshot holds the totals of a run at a given time
+type ProgressSnapshot struct {
+	// Start is when the first event was received
+	Start time.Time
+
+	// WalkDone is true once every file has been discovered
+	WalkDone bool
+
+	FilesDiscovered int
+	FilesHashed     int
+	FilesDone       int
+	FilesFailed     int
+
+	BytesDiscovered int64
+	BytesDone       int64
+	BytesSaved      int64
+
+	// Current maps each worker to the file it is processing
+	Current map[int]string
+}
+
+// NewProgress creates a new Progress
+func NewProgress() *Progress {
+	return &Progress{snapshot: ProgressSnapshot{Current: make(map[int]string)}}
+}
+
+// Handle updates the totals with the given event
+func (p *Progress) Handle(event ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &p.snapshot
+	if s.Start.IsZero() {
+		s.Start = time.Now()
+	}
+
+	switch event.Kind {
+	case EventDiscovered:
+		s.FilesDiscovered++
+		s.BytesDiscovered += event.Size
+	case EventWalkDone:
+		s.WalkDone = true
+	case EventStarted:
+		s.Current[event.Worker] = event.Path
+	case EventHashed:
+		s.FilesHashed++
+	case EventSkipped, EventStored, EventLinked, EventFailed:
+		if event.Kind == EventFailed {
+			s.FilesFailed++
+		}
+		s.FilesDone++
+		s.BytesDone += event.Size
+		s.BytesSaved += event.Saved
+		delete(s.Current, event.Worker)
+	}
+}
+
+// Snapshot returns a copy of the current totals
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.snapshot
+	s.Current = make(map[int]string, len(p.snapshot.Current))
+	for worker, path := range p.snapshot.Current {
+		s.Current[worker] = path
+	}
+	return s
+}
+
+// ETA estimates the time left from the throughput so far and the bytes
+// discovered, it is an underestimate until the walk is done. False is
+// returned if no estimate is possible yet
+func (s ProgressSnapshot) ETA() (time.Duration, bool) {
+	if s.BytesDone == 0 || s.Start.IsZero() {
+		return 0, false
+	}
+
+	elapsed := time.Since(s.Start)
+	left := s.BytesDiscovered - s.BytesDone
+	return time.Duration(float64(elapsed) * float64(left) / float64(s.BytesDone)), true
+}
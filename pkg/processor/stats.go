@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"sync"
+	"time"
+)
+
+// DedupStats collects information about the deduplication process, it is
+// safe to update from several workers and meant to be read once the run is
+// over
+type DedupStats struct {
+	WalkStats
+
+	mu sync.Mutex
+
+	// Processed is the number of files stored or linked
+	Processed int `json:"processed"`
+
+	// Skipped is the number of files skipped as unchanged since the last
+	// run, according to the cache
+	Skipped int `json:"skipped"`
+
+	// CacheHits is the number of files whose size and modification time
+	// match the cache, even if no longer linked
+	CacheHits int `json:"cache_hits"`
+
+	// BytesScanned is the size of the files hashed
+	BytesScanned int64 `json:"bytes_scanned"`
+
+	// BytesReclaimed is the size of the files replaced by links to
+	// existing objects
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+
+	// NewObjects is the number of objects created
+	NewObjects int `json:"new_objects"`
+
+	// ReusedObjects is the number of files linked to existing objects
+	ReusedObjects int `json:"reused_objects"`
+
+	// AlreadyLinked is the number of files found linked to their object
+	// already, which were left as they are
+	AlreadyLinked int `json:"already_linked"`
+
+	// Duration is how long the run took
+	Duration time.Duration `json:"duration_ns"`
+
+	// Collisions holds the files whose content differs from the stored
+	// object with the same hash, found in paranoid mode
+	Collisions []string `json:"collisions"`
+
+	// ConflictsSkipped holds the destinations that already existed and were
+	// left as they are by the conflict policy
+	ConflictsSkipped []string `json:"conflicts_skipped"`
+
+	// ConflictsReplaced holds the destinations that already existed and
+	// were replaced by a link, or moved aside with the backup policy
+	ConflictsReplaced []string `json:"conflicts_replaced"`
+
+	// Failures holds the files that could not be processed, including the
+	// ones the walker could not access
+	Failures []*FileError `json:"failures"`
+
+	// ErrorsByStage counts the failures by the stage they happened at
+	ErrorsByStage map[Stage]int `json:"errors_by_stage"`
+
+	// Workers holds the statistics of each worker
+	Workers []WorkerStats `json:"workers"`
+}
+
+// WorkerStats collects information about the files handled by a worker
+type WorkerStats struct {
+	// Files is the number of files handled, failed ones included
+	Files int `json:"files"`
+
+	// Bytes is the size of the files handled
+	Bytes int64 `json:"bytes"`
+
+	// Busy is the time spent handling files
+	Busy time.Duration `json:"busy_ns"`
+
+	// BytesPerSecond is the throughput while busy
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// reset prepares the statistics for a run with the given number of workers
+func (s *DedupStats) reset(workers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Processed = 0
+	s.Skipped = 0
+	s.CacheHits = 0
+	s.BytesScanned = 0
+	s.BytesReclaimed = 0
+	s.NewObjects = 0
+	s.ReusedObjects = 0
+	s.AlreadyLinked = 0
+	s.Duration = 0
+	s.Collisions = nil
+	s.ConflictsSkipped = nil
+	s.ConflictsReplaced = nil
+	s.Failures = nil
+	s.ErrorsByStage = make(map[Stage]int)
+	s.Workers = make([]WorkerStats, workers)
+}
+
+// addCacheHit records a file matching the cache, skipped if still linked
+func (s *DedupStats) addCacheHit(skipped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.CacheHits++
+	if skipped {
+		s.Skipped++
+	}
+}
+
+// addScanned records a hashed file
+func (s *DedupStats) addScanned(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.BytesScanned += size
+}
+
+// addProcessed records a file stored as a new object or linked to an
+// existing one
+func (s *DedupStats) addProcessed(size int64, reused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Processed++
+	if reused {
+		s.ReusedObjects++
+		s.BytesReclaimed += size
+	} else {
+		s.NewObjects++
+	}
+}
+
+// addAlreadyLinked records a file found linked to its object already, which
+// reclaims nothing
+func (s *DedupStats) addAlreadyLinked() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Processed++
+	s.AlreadyLinked++
+}
+
+// addCopied records a file linked to a destination instead of copied, only
+// reclaiming its size if the object already existed, as a new object holds
+// the one copy of the data
+func (s *DedupStats) addCopied(size int64, newObject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Processed++
+	if newObject {
+		s.NewObjects++
+	} else {
+		s.ReusedObjects++
+		s.BytesReclaimed += size
+	}
+}
+
+// addCollision records a file colliding with a stored object
+func (s *DedupStats) addCollision(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Collisions = append(s.Collisions, path)
+}
+
+// addConflict records a destination that already existed, replaced or skipped
+func (s *DedupStats) addConflict(path string, replaced bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replaced {
+		s.ConflictsReplaced = append(s.ConflictsReplaced, path)
+	} else {
+		s.ConflictsSkipped = append(s.ConflictsSkipped, path)
+	}
+}
+
+// addFailure records a file that could not be processed
+func (s *DedupStats) addFailure(err *FileError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Failures = append(s.Failures, err)
+}
+
+// addWork records the time a worker spent on a file
+func (s *DedupStats) addWork(worker int, size int64, busy time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if worker < 0 || worker >= len(s.Workers) {
+		return
+	}
+	w := &s.Workers[worker]
+	w.Files++
+	w.Bytes += size
+	w.Busy += busy
+}
+
+// finish completes the statistics at the end of the run, merging the
+// failures of the walk
+func (s *DedupStats) finish(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Duration = duration
+	s.Failures = append(append([]*FileError(nil), s.WalkStats.Errors...), s.Failures...)
+	for _, failure := range s.Failures {
+		s.ErrorsByStage[failure.Stage]++
+	}
+	for i := range s.Workers {
+		w := &s.Workers[i]
+		if w.Busy > 0 {
+			w.BytesPerSecond = float64(w.Bytes) / w.Busy.Seconds()
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mirkobrombin/dabadee/pkg/ignore"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+)
+
+// Walker walks a directory tree looking for the files to process, skipping
+// storages and the paths excluded by the ignore rules
+type Walker struct {
+	// Exclude holds gitignore-style patterns of the paths to skip, relative
+	// to the walked directory
+	Exclude []string
+
+	// Include holds gitignore-style patterns of the paths to process even
+	// if excluded, they are applied after the Exclude ones
+	Include []string
+
+	// NoIgnoreFiles disables reading the .dabadeeignore files found in the
+	// walked directories
+	NoIgnoreFiles bool
+
+	// Filters holds the predicates a file must satisfy to be processed,
+	// more can be appended to extend the selection
+	Filters []Filter
+
+	// OneFileSystem stops the walk at device boundaries, skipping the
+	// directories where other filesystems are mounted
+	OneFileSystem bool
+
+	// FailFast stops at the first file that cannot be accessed or
+	// processed, instead of going on with the others
+	FailFast bool
+}
+
+// WalkStats collects information about the walk
+type WalkStats struct {
+	// Rules holds the ignore rules in effect, in order of precedence
+	Rules []string `json:"rules"`
+
+	// Ignored maps each skipped path to the rule excluding it
+	Ignored map[string]string `json:"ignored"`
+
+	// Filtered is the number of files rejected by the filters
+	Filtered int `json:"filtered"`
+
+	// Special is the number of FIFOs, sockets and device nodes skipped
+	Special int `json:"special"`
+
+	// Mounts holds the directories skipped as other filesystems are
+	// mounted there, in one-file-system mode
+	Mounts []string `json:"mounts"`
+
+	// Errors holds the paths that could not be accessed
+	Errors []*FileError `json:"-"`
+}
+
+// merge adds the statistics of another walk
+func (s *WalkStats) merge(other WalkStats) {
+	if s.Ignored == nil {
+		s.Ignored = make(map[string]string)
+	}
+	for path, rule := range other.Ignored {
+		s.Ignored[path] = rule
+	}
+	s.Rules = append(s.Rules, other.Rules...)
+	s.Filtered += other.Filtered
+	s.Special += other.Special
+	s.Mounts = append(s.Mounts, other.Mounts...)
+	s.Errors = append(s.Errors, other.Errors...)
+}
+
+// matcher creates the matcher for the rules given as flags
+func (w *Walker) matcher(root string) (*ignore.Matcher, error) {
+	var rules []ignore.Rule
+	add := func(pattern, source string) error {
+		rule, ok, err := ignore.ParseRule(pattern, root, source, 0)
+		if err != nil {
+			return err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+		return nil
+	}
+
+	for _, pattern := range w.Exclude {
+		if err := add(pattern, "--exclude"); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range w.Include {
+		if err := add("!"+pattern, "--include"); err != nil {
+			return nil, err
+		}
+	}
+
+	return ignore.NewMatcher(rules), nil
+}
+
+// fail records a path that cannot be accessed, stopping the walk with the
+// error in fail-fast mode
+func (w *Walker) fail(stats *WalkStats, err *FileError) error {
+	stats.Errors = append(stats.Errors, err)
+	if w.FailFast {
+		return err
+	}
+	return nil
+}
+
+// accept checks if the file satisfies every filter
+func (w *Walker) accept(path string, info os.FileInfo) bool {
+	for _, filter := range w.Filters {
+		if !filter(path, info) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkState holds what is needed to decide on the paths under a root
+type walkState struct {
+	root    string
+	rootDev uint64
+	matcher *ignore.Matcher
+	stats   *WalkStats
+	verbose bool
+}
+
+// start prepares a walk of the given directory, resetting the stats
+func (w *Walker) start(root string, verbose bool, stats *WalkStats) (*walkState, error) {
+	m, err := w.matcher(root)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ignore rules: %w", err)
+	}
+	stats.Ignored = make(map[string]string)
+	stats.Filtered = 0
+	stats.Special = 0
+	stats.Mounts = nil
+	stats.Errors = nil
+
+	st := &walkState{root: root, matcher: m, stats: stats, verbose: verbose}
+	if w.OneFileSystem {
+		st.rootDev, err = storage.DeviceOf(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// end records the ignore rules in effect in the stats
+func (st *walkState) end() {
+	st.stats.Rules = nil
+	for _, rule := range st.matcher.Rules() {
+		st.stats.Rules = append(st.stats.Rules, rule.String())
+	}
+}
+
+// skip checks if the given path is a storage, a mount point to stay out of
+// or excluded by the ignore rules. Directories are skipped with
+// filepath.SkipDir
+func (w *Walker) skip(st *walkState, path string, info os.FileInfo) (bool, error) {
+	verbose, stats := st.verbose, st.stats
+
+	if info.IsDir() && storage.IsStorageRoot(path) {
+		if verbose {
+			log.Printf("Skipping storage directory %s", path)
+		}
+		return true, filepath.SkipDir
+	}
+
+	if info.IsDir() && w.OneFileSystem {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && uint64(stat.Dev) != st.rootDev {
+			if verbose {
+				log.Printf("Skipping mount point %s", path)
+			}
+			stats.Mounts = append(stats.Mounts, path)
+			return true, filepath.SkipDir
+		}
+	}
+
+	if rule := st.matcher.Match(path, info.IsDir()); rule != nil && !rule.Negate {
+		if verbose {
+			log.Printf("Ignoring %s due to rule %s", path, rule)
+		}
+		stats.Ignored[path] = rule.String()
+		if info.IsDir() {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// visit decides about the given path, returning true for a file to process.
+// Directories not to descend into are reported with filepath.SkipDir
+func (w *Walker) visit(st *walkState, path string, info os.FileInfo) (bool, error) {
+	verbose, stats := st.verbose, st.stats
+
+	if skip, err := w.skip(st, path, info); skip {
+		return false, err
+	}
+
+	if info.IsDir() {
+		if w.NoIgnoreFiles {
+			return false, nil
+		}
+		err := st.matcher.LoadDir(path)
+		if err != nil && verbose {
+			log.Printf("Error loading ignore file in %s: %v", path, err)
+		}
+		return false, nil
+	}
+
+	// Opening special files, directly or through a symlink, may block
+	// or have side effects, and they cannot be deduplicated anyway
+	mode := info.Mode()
+	if mode&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil {
+			mode = target.Mode()
+		}
+	}
+	if mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) != 0 {
+		if verbose {
+			log.Printf("Skipping special file %s", path)
+		}
+		stats.Special++
+		return false, nil
+	}
+
+	if !w.accept(path, info) {
+		if verbose {
+			log.Printf("Skipping filtered file %s", path)
+		}
+		stats.Filtered++
+		return false, nil
+	}
+
+	// Check if we have permission to read the file
+	file, err := os.Open(path)
+	if err != nil {
+		if verbose {
+			log.Printf("Skipping file %s due to permissions: %v", path, err)
+		}
+		return false, w.fail(stats, &FileError{Path: path, Stage: StageOpen, Err: err})
+	}
+	file.Close()
+
+	return true, nil
+}
+
+// Walk walks the given directory, calling fn for every file that is readable
+// and not ignored. The walk stops with the context error once cancelled
+func (w *Walker) Walk(ctx context.Context, root string, verbose bool, stats *WalkStats, fn func(path string, info os.FileInfo) error) error {
+	st, err := w.start(root, verbose, stats)
+	if err != nil {
+		return err
+	}
+	defer st.end()
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			if path == root {
+				return err
+			}
+			if verbose {
+				log.Printf("Error accessing path %s: %v", path, err)
+			}
+			return w.fail(stats, &FileError{Path: path, Stage: StageWalk, Err: err})
+		}
+
+		ok, err := w.visit(st, path, info)
+		if !ok || err != nil {
+			return err
+		}
+
+		return fn(path, info)
+	})
+}
@@ -0,0 +1,279 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchMask is the set of inotify events the watched directories report
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// WatchProcessor is a processor that keeps deduplicating the files written to
+// a directory. Files are processed in batches once they have been closed and
+// left untouched for a while, through the same pipeline of DedupProcessor
+type WatchProcessor struct {
+	// Dedup processes the files, its Source is the watched directory and
+	// its options apply to the watched files
+	Dedup *DedupProcessor
+
+	// Debounce is how long a file must be left untouched after being
+	// written before it is processed
+	Debounce time.Duration
+
+	// InitialScan processes the files already in the directory first
+	InitialScan bool
+
+	// Stats holds statistics about the watched files, the ones of each
+	// batch are in the Stats of Dedup
+	Stats WalkStats
+
+	watches map[int32]string
+	pending map[string]pendingFile
+}
+
+// pendingFile is a written file waiting to be processed
+type pendingFile struct {
+	// seen is when the file was last written
+	seen time.Time
+
+	size    int64
+	modTime time.Time
+}
+
+// inotifyEvent is an event read from inotify
+type inotifyEvent struct {
+	wd   int32
+	mask uint32
+	name string
+}
+
+// NewWatchProcessor creates a new WatchProcessor
+func NewWatchProcessor(dedup *DedupProcessor, debounce time.Duration) *WatchProcessor {
+	return &WatchProcessor{
+		Dedup:       dedup,
+		Debounce:    debounce,
+		InitialScan: true,
+	}
+}
+
+// Process watches the directory until the context is cancelled, returning
+// the context error. Failing files are logged and do not stop the watch
+func (p *WatchProcessor) Process(ctx context.Context, verbose bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("initializing inotify: %w", err)
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+
+	st, err := p.Dedup.start(p.Dedup.Source, verbose, &p.Stats)
+	if err != nil {
+		return err
+	}
+	defer st.end()
+
+	p.watches = make(map[int32]string)
+	p.pending = make(map[string]pendingFile)
+	err = p.addTree(fd, st, p.Dedup.Source, p.InitialScan)
+	if err != nil {
+		return err
+	}
+
+	events := make(chan inotifyEvent)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readInotify(ctx, file, events)
+	}()
+
+	interval := p.Debounce / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("reading inotify events: %w", err)
+		case event := <-events:
+			p.handle(fd, st, event)
+		case <-ticker.C:
+			ready := p.ready()
+			if len(ready) == 0 {
+				continue
+			}
+			if verbose {
+				log.Printf("Processing %d files", len(ready))
+			}
+			err := p.Dedup.ProcessFiles(ctx, ready, verbose)
+			var partial *PartialError
+			if errors.As(err, &partial) {
+				for _, failure := range partial.Errors {
+					log.Printf("Error processing file %s: %v", failure.Path, failure.Err)
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// addTree watches the given directory and its subdirectories, queueing the
+// files found if requested
+func (p *WatchProcessor) addTree(fd int, st *walkState, root string, queue bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			if st.verbose {
+				log.Printf("Error accessing path %s: %v", path, err)
+			}
+			return nil
+		}
+
+		ok, err := p.Dedup.visit(st, path, info)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			wd, err := syscall.InotifyAddWatch(fd, path, watchMask)
+			if err != nil {
+				return fmt.Errorf("watching %s: %w", path, err)
+			}
+			p.watches[int32(wd)] = path
+			return nil
+		}
+
+		if ok && queue {
+			p.touch(path, info)
+		}
+		return nil
+	})
+}
+
+// handle updates the pending files according to the given event
+func (p *WatchProcessor) handle(fd int, st *walkState, event inotifyEvent) {
+	if event.mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events have been lost, look at the whole directory again
+		log.Printf("Too many events, rescanning %s", p.Dedup.Source)
+		if err := p.addTree(fd, st, p.Dedup.Source, true); err != nil {
+			log.Printf("Error rescanning %s: %v", p.Dedup.Source, err)
+		}
+		return
+	}
+
+	dir, ok := p.watches[event.wd]
+	if !ok {
+		return
+	}
+	if event.mask&syscall.IN_IGNORED != 0 {
+		delete(p.watches, event.wd)
+		return
+	}
+	path := filepath.Join(dir, event.name)
+
+	switch {
+	case event.mask&syscall.IN_ISDIR != 0:
+		// Directories moved in already hold files
+		if event.mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := p.addTree(fd, st, path, true); err != nil {
+				log.Printf("Error watching %s: %v", path, err)
+			}
+		}
+	case event.mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		info, err := os.Lstat(path)
+		if err != nil {
+			return
+		}
+		if ok, _ := p.Dedup.visit(st, path, info); ok {
+			p.touch(path, info)
+		}
+	case event.mask&syscall.IN_MODIFY != 0:
+		// Still being written, wait longer
+		if pending, ok := p.pending[path]; ok {
+			pending.seen = time.Now()
+			p.pending[path] = pending
+		}
+	case event.mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		delete(p.pending, path)
+	}
+}
+
+// touch marks the given file as written now
+func (p *WatchProcessor) touch(path string, info os.FileInfo) {
+	p.pending[path] = pendingFile{seen: time.Now(), size: info.Size(), modTime: info.ModTime()}
+}
+
+// ready returns the pending files left untouched for long enough, and still
+// unchanged since last seen
+func (p *WatchProcessor) ready() []string {
+	var ready []string
+	for path, pending := range p.pending {
+		if time.Since(pending.seen) < p.Debounce {
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			delete(p.pending, path)
+			continue
+		}
+		if info.Size() != pending.size || !info.ModTime().Equal(pending.modTime) {
+			p.touch(path, info)
+			continue
+		}
+
+		delete(p.pending, path)
+		ready = append(ready, path)
+	}
+
+	return ready
+}
+
+// readInotify reads the events of the given inotify file and sends them on
+// the channel, until the context is cancelled or reading fails
+func readInotify(ctx context.Context, file *os.File, events chan<- inotifyEvent) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			event := inotifyEvent{
+				wd:   raw.Wd,
+				mask: raw.Mask,
+				name: strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00"),
+			}
+			offset = nameEnd
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
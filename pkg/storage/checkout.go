@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrObjectNotFound is the error of a checkout of an object missing from the
+// storage
+var ErrObjectNotFound = errors.New("object not found in storage")
+
+// CheckoutReport describes what CheckoutManifest did
+type CheckoutReport struct {
+	// CheckedOut holds the paths created
+	CheckedOut []string `json:"checked_out"`
+
+	// Skipped holds the paths already linked to their object
+	Skipped []string `json:"skipped"`
+}
+
+// Checkout creates a path at dest for the object with the given hash, linked
+// to it according to the link mode or, if copyFiles is set, as an independent
+// copy. An existing dest is an error, unless already linked to the object
+func (s *Storage) Checkout(hash, dest string, copyFiles bool) error {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	objectPath, err := s.checkoutObject(hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.checkout(hash, objectPath, dest, copyFiles, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.index.Save()
+}
+
+// CheckoutManifest recreates the paths of the given manifest under root, like
+// Checkout does for each of them. Leading slashes are stripped from the paths,
+// like tar does, so absolute ones are recreated under root too. Copies get
+// the metadata of the manifest, if any, while links share the one of their
+// object. Nothing is created if any object is missing
+func (s *Storage) CheckoutManifest(manifest Manifest, root string, copyFiles bool) (*CheckoutReport, error) {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	paths := make([]string, 0, len(manifest))
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// Check every path and object before touching anything
+	dests := make(map[string]string, len(paths))
+	objects := make(map[string]string, len(paths))
+	var missing []string
+	for _, p := range paths {
+		dest, err := checkoutPath(root, p)
+		if err != nil {
+			return nil, err
+		}
+		dests[p] = dest
+
+		hash := manifest[p].Hash
+		objectPath, err := s.checkoutObject(hash)
+		if errors.Is(err, ErrObjectNotFound) {
+			missing = append(missing, fmt.Sprintf("%s (%s)", p, hash))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects[hash] = objectPath
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, strings.Join(missing, ", "))
+	}
+
+	report := &CheckoutReport{}
+	for _, p := range paths {
+		entry := manifest[p]
+		created, err := s.checkout(entry.Hash, objects[entry.Hash], dests[p], copyFiles, entry.Metadata)
+		if err != nil {
+			s.index.Save()
+			return report, fmt.Errorf("%s: %w", p, err)
+		}
+
+		if created {
+			report.CheckedOut = append(report.CheckedOut, dests[p])
+		} else {
+			report.Skipped = append(report.Skipped, dests[p])
+		}
+	}
+
+	return report, s.index.Save()
+}
+
+// checkoutObject returns the path of the object with the given hash, failing
+// with ErrObjectNotFound if missing
+func (s *Storage) checkoutObject(hash string) (string, error) {
+	if hash == "" || hash == "." || hash == ".." || strings.ContainsRune(hash, filepath.Separator) {
+		return "", fmt.Errorf("invalid object name %q", hash)
+	}
+
+	objectPath, exists, err := s.FindObject(hash)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%s: %w", hash, ErrObjectNotFound)
+	}
+
+	return objectPath, nil
+}
+
+// checkout creates dest for the object with the given hash and path, applying
+// the given metadata to copies. It reports false if dest was already linked
+// to the object
+func (s *Storage) checkout(hash, objectPath, dest string, copyFiles bool, metadata *FileMetadata) (bool, error) {
+	if info, err := os.Lstat(dest); err == nil {
+		if !copyFiles && s.IsLinked(dest, info, hash) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", dest, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	if copyFiles {
+		err = copyFile(objectPath, dest)
+		if err != nil {
+			return false, err
+		}
+		if metadata != nil {
+			return true, applyMetadata(dest, *metadata)
+		}
+		return true, nil
+	}
+
+	err = s.CreateLink(objectPath, dest)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.AddReference(hash, dest)
+	if err != nil {
+		return false, err
+	}
+
+	// Links are found walking the registered paths
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return false, err
+	}
+	return true, s.storeNewPath(filepath.Dir(absDest))
+}
+
+// checkoutPath returns where the given manifest path is checked out under
+// root, without its leading slashes
+func checkoutPath(root, path string) (string, error) {
+	rel := strings.TrimLeft(filepath.Clean(path), string(filepath.Separator))
+	if rel == "" || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid manifest path %q", path)
+	}
+
+	return filepath.Join(root, rel), nil
+}
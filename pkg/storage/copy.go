@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFile copies the source file to the destination path, carrying over its
+// permissions, ownership and times. The data is written to a temporary file
+// next to the destination first, so the destination is never seen partially
+// written
+func copyFile(sourcePath, destPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(destPath), "."+filepath.Base(destPath)+".tmp")
+	dest, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dest, source)
+	if err == nil {
+		err = dest.Sync()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = CopyAttributes(tmpPath, info)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+// SameContent compares the content of two files byte by byte
+func SameContent(a, b string) (bool, error) {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// CopyAttributes applies the ownership, permissions and times described by
+// info to the given path, without following symlinks. Ownership is only
+// changed when allowed to
+func CopyAttributes(path string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		err := os.Lchown(path, int(stat.Uid), int(stat.Gid))
+		if err != nil && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+	}
+
+	// Symlinks have no permissions of their own
+	if info.Mode()&os.ModeSymlink != 0 {
+		mtime := unix.NsecToTimespec(info.ModTime().UnixNano())
+		err := unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return &os.PathError{Op: "utimensat", Path: path, Err: err}
+		}
+		return nil
+	}
+
+	err := os.Chmod(path, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrCrossDevice is returned when a path lives on a different filesystem than
+// the storage, so it cannot be renamed into it nor linked from it
+var ErrCrossDevice = errors.New("path is on a different filesystem than the storage")
+
+// DeviceOf returns the ID of the device holding the given path, if the path
+// does not exist yet the closest existing parent is looked up instead
+func DeviceOf(path string) (uint64, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		info, err := os.Stat(absPath)
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, os.ErrInvalid
+			}
+			return uint64(stat.Dev), nil
+		}
+
+		parent := filepath.Dir(absPath)
+		if !os.IsNotExist(err) || parent == absPath {
+			return 0, err
+		}
+		absPath = parent
+	}
+}
+
+// CheckSameDevice checks that every given path lives on the same filesystem
+// as the storage, empty paths are ignored
+func (s *Storage) CheckSameDevice(paths ...string) error {
+	storageDev, err := DeviceOf(s.Opts.Root)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		dev, err := DeviceOf(path)
+		if err != nil {
+			return err
+		}
+
+		if dev != storageDev {
+			return fmt.Errorf("%s: %w %s", path, ErrCrossDevice, s.Opts.Root)
+		}
+	}
+
+	return nil
+}
+
+// IsStorageRoot checks if the given directory is the root of a storage
+func IsStorageRoot(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ".dabadee"))
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,544 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// IndexEntry holds what is known about an object in the storage
+type IndexEntry struct {
+	Size      int64    `json:"size"`
+	Inode     uint64   `json:"inode"`
+	FirstSeen int64    `json:"first_seen"`
+	Paths     []string `json:"paths"`
+}
+
+// Index maps the hash of each object in the storage to its IndexEntry, so
+// that the paths referencing an object can be found without walking the
+// registered paths
+type Index struct {
+	Path string `json:"-"`
+
+	// Complete is true when every object and reference is known to the
+	// index, if false lookups fall back to walking the filesystem
+	Complete bool `json:"complete"`
+
+	Entries map[string]*IndexEntry `json:"entries"`
+
+	mu      sync.Mutex
+	byPath  map[string]string
+	byInode map[uint64]string
+
+	// stamp identifies the file last loaded or saved, to tell whether
+	// another process has saved it since
+	stamp fileStamp
+
+	// dirty is true once the marker telling that the index on disk is behind
+	// the storage has been written, see markDirty
+	dirty bool
+}
+
+// fileStamp identifies a version of a file, each save of the index renames a
+// new file in place so it gets a new inode
+type fileStamp struct {
+	inode   uint64
+	size    int64
+	modTime int64
+}
+
+// newFileStamp returns the stamp of the file described by info
+func newFileStamp(info os.FileInfo) fileStamp {
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		stamp.inode = stat.Ino
+	}
+	return stamp
+}
+
+// loadIndex loads the index at the given path, a missing index results in an
+// empty one, complete only if requested. The index is not complete if a
+// process stopped before saving its changes
+func loadIndex(path string, complete bool) (*Index, error) {
+	idx := &Index{Path: path, Complete: complete, Entries: make(map[string]*IndexEntry)}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			idx.reindex()
+			return idx, idx.checkDirty()
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(idx); err != nil {
+		return nil, err
+	}
+	if idx.Entries == nil {
+		idx.Entries = make(map[string]*IndexEntry)
+	}
+	if info, err := f.Stat(); err == nil {
+		idx.stamp = newFileStamp(info)
+	}
+
+	idx.reindex()
+	return idx, idx.checkDirty()
+}
+
+// dirtyPath returns the path of the marker written before changing the
+// storage and removed once the index is saved
+func (idx *Index) dirtyPath() string {
+	return idx.Path + ".dirty"
+}
+
+// checkDirty marks the index as incomplete if the marker was left behind,
+// the caller must hold the mutex or own the index
+func (idx *Index) checkDirty() error {
+	_, err := os.Stat(idx.dirtyPath())
+	if os.IsNotExist(err) {
+		idx.dirty = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	idx.dirty = true
+	idx.Complete = false
+	return nil
+}
+
+// markDirty writes the marker telling that the index on disk is behind the
+// storage, so that a process stopping before saving the index leaves it
+// incomplete. It must be called before changing the storage
+func (idx *Index) markDirty() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.dirty || !idx.Complete {
+		return nil
+	}
+
+	f, err := os.Create(idx.dirtyPath())
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	idx.dirty = true
+	return nil
+}
+
+// reload replaces the index in memory with the one on disk if another process
+// has saved it since it was last loaded or saved, and marks it incomplete if
+// a process stopped before saving its changes. The caller must hold the
+// storage lock so that it cannot change in the meantime
+func (idx *Index) reload() error {
+	info, err := os.Stat(idx.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err == nil && newFileStamp(info) != idx.stamp {
+		loaded, err := loadIndex(idx.Path, false)
+		if err != nil {
+			return fmt.Errorf("reloading index: %w", err)
+		}
+
+		idx.Complete = loaded.Complete
+		idx.Entries = loaded.Entries
+		idx.byPath = loaded.byPath
+		idx.byInode = loaded.byInode
+		idx.stamp = loaded.stamp
+	}
+
+	return idx.checkDirty()
+}
+
+// reindex rebuilds the in-memory lookup tables
+func (idx *Index) reindex() {
+	idx.byPath = make(map[string]string)
+	idx.byInode = make(map[uint64]string)
+	for hash, entry := range idx.Entries {
+		idx.byInode[entry.Inode] = hash
+		for _, p := range entry.Paths {
+			idx.byPath[p] = hash
+		}
+	}
+}
+
+// Save writes the index to disk, replacing the previous one atomically
+func (idx *Index) Save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	tmpPath := idx.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(f).Encode(idx)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, idx.Path)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(idx.Path); err == nil {
+		idx.stamp = newFileStamp(info)
+	}
+
+	// Every change is saved now
+	err = os.Remove(idx.dirtyPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// Get returns a copy of the entry for the given hash
+func (idx *Index) Get(hash string) (IndexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, ok := idx.Entries[hash]
+	if !ok {
+		return IndexEntry{}, false
+	}
+
+	e := *entry
+	e.Paths = append([]string(nil), entry.Paths...)
+	return e, true
+}
+
+// Len returns the number of objects in the index
+func (idx *Index) Len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return len(idx.Entries)
+}
+
+// Lookup returns the hash of the object referenced by the given path or
+// sharing the given inode
+func (idx *Index) Lookup(path string, inode uint64) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if hash, ok := idx.byPath[path]; ok {
+		return hash, true
+	}
+
+	hash, ok := idx.byInode[inode]
+	return hash, ok
+}
+
+// lookupPath returns the hash of the object referenced by the given path
+func (idx *Index) lookupPath(path string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	hash, ok := idx.byPath[path]
+	return hash, ok
+}
+
+// add records the object with the given hash, if not known yet
+func (idx *Index) add(hash string, info os.FileInfo) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.Entries[hash]; ok {
+		return
+	}
+
+	entry := &IndexEntry{
+		Size:      info.Size(),
+		FirstSeen: time.Now().Unix(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Inode = stat.Ino
+	}
+
+	idx.Entries[hash] = entry
+	idx.byInode[entry.Inode] = hash
+}
+
+// addRef records that the given path references the object with the given
+// hash, the object must have been added first
+func (idx *Index) addRef(hash, path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, ok := idx.Entries[hash]
+	if !ok {
+		return
+	}
+
+	// Drop the reference from the object the path was pointing to before
+	if previous, ok := idx.byPath[path]; ok {
+		if previous == hash {
+			return
+		}
+		idx.dropRef(previous, path)
+	}
+
+	entry.Paths = append(entry.Paths, path)
+	idx.byPath[path] = hash
+}
+
+// removeRef removes the reference of the given path, if any
+func (idx *Index) removeRef(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if hash, ok := idx.byPath[path]; ok {
+		idx.dropRef(hash, path)
+	}
+}
+
+// dropRef removes a reference, the caller must hold the mutex
+func (idx *Index) dropRef(hash, path string) {
+	delete(idx.byPath, path)
+
+	entry, ok := idx.Entries[hash]
+	if !ok {
+		return
+	}
+
+	for i, p := range entry.Paths {
+		if p == path {
+			entry.Paths = append(entry.Paths[:i], entry.Paths[i+1:]...)
+			break
+		}
+	}
+}
+
+// remove forgets the object with the given hash and its references
+func (idx *Index) remove(hash string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, ok := idx.Entries[hash]
+	if !ok {
+		return
+	}
+
+	for _, p := range entry.Paths {
+		delete(idx.byPath, p)
+	}
+	if idx.byInode[entry.Inode] == hash {
+		delete(idx.byInode, entry.Inode)
+	}
+	delete(idx.Entries, hash)
+}
+
+// hasRefUnder checks if any reference lives under the given directory
+func (idx *Index) hasRefUnder(dir string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for p := range idx.byPath {
+		if isSubPath(dir, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Index returns the object index of the storage
+func (s *Storage) Index() *Index {
+	return s.index
+}
+
+// SaveIndex writes the object index to disk
+func (s *Storage) SaveIndex() error {
+	return s.index.Save()
+}
+
+// AddReference records in the index that the given path references the
+// object with the given hash
+func (s *Storage) AddReference(hash, path string) error {
+	objectPath, exists, err := s.FindObject(hash)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return os.ErrNotExist
+	}
+
+	info, err := os.Lstat(objectPath)
+	if err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	err = s.index.markDirty()
+	if err != nil {
+		return err
+	}
+
+	s.index.add(hash, info)
+	s.index.addRef(hash, absPath)
+	return nil
+}
+
+// RemoveReference forgets in the index the reference of the given path, if
+// any
+func (s *Storage) RemoveReference(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	err = s.index.markDirty()
+	if err != nil {
+		return err
+	}
+
+	s.index.removeRef(absPath)
+	return nil
+}
+
+// RebuildIndex regenerates the index from scratch, looking at every object
+// in the storage and walking the registered paths once to find their links
+func (s *Storage) RebuildIndex() error {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	idx := &Index{Path: s.index.Path, Complete: true, Entries: make(map[string]*IndexEntry)}
+	byInode := make(map[uint64]string)
+
+	// Collect the objects
+	err = s.walkObjects(func(path string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return os.ErrInvalid
+		}
+
+		hash := d.Name()
+		entry := &IndexEntry{
+			Size:      info.Size(),
+			Inode:     stat.Ino,
+			FirstSeen: time.Now().Unix(),
+		}
+		if previous, ok := s.index.Get(hash); ok {
+			entry.FirstSeen = previous.FirstSeen
+		}
+
+		idx.Entries[hash] = entry
+		byInode[stat.Ino] = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Collect the references
+	for _, root := range s.Opts.Paths {
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			// Symlinks into the storage are matched against their target
+			if info.Mode()&os.ModeSymlink != 0 {
+				targetInfo, ok := s.resolveLink(path)
+				if !ok {
+					return nil
+				}
+				info = targetInfo
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return nil
+			}
+
+			if hash, ok := byInode[stat.Ino]; ok {
+				absPath, err := filepath.Abs(path)
+				if err != nil {
+					return err
+				}
+				idx.Entries[hash].Paths = append(idx.Entries[hash].Paths, absPath)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Reflinks cannot be found by inode, keep the ones previously known
+	if s.usesReflinks() {
+		for hash, entry := range idx.Entries {
+			previous, ok := s.index.Get(hash)
+			if !ok {
+				continue
+			}
+
+			known := make(map[string]bool)
+			for _, p := range entry.Paths {
+				known[p] = true
+			}
+
+			for _, p := range previous.Paths {
+				info, err := os.Lstat(p)
+				if err == nil && !known[p] && info.Mode().IsRegular() && info.Size() == entry.Size {
+					entry.Paths = append(entry.Paths, p)
+				}
+			}
+		}
+	}
+
+	idx.reindex()
+	err = idx.Save()
+	if err != nil {
+		return err
+	}
+
+	s.index = idx
+	return nil
+}
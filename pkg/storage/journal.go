@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// JournalOp is the kind of operation recorded in the journal
+type JournalOp string
+
+const (
+	// JournalMove records a file being renamed into the storage and linked
+	// back to its original path
+	JournalMove JournalOp = "move"
+
+	// JournalReplace records a file being removed and replaced by a link to
+	// an object already in the storage
+	JournalReplace JournalOp = "replace"
+)
+
+// JournalEntry is an operation recorded in the journal before touching the
+// filesystem, a second entry with the same ID and Done set marks its end
+type JournalEntry struct {
+	ID   string    `json:"id"`
+	Op   JournalOp `json:"op,omitempty"`
+	Hash string    `json:"hash,omitempty"`
+	Path string    `json:"path,omitempty"`
+	Done bool      `json:"done,omitempty"`
+}
+
+// RecoveryAction describes what was done about a half-finished operation
+type RecoveryAction struct {
+	Entry JournalEntry `json:"entry"`
+
+	// Action is one of "relinked" when the missing link was created,
+	// "rolled-back" when the path was left unlinked, "completed" when only
+	// the journal was behind and "lost" when neither the path nor the object
+	// exist anymore
+	Action string `json:"action"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// journal is the write-ahead log of the storage, kept in its root
+type journal struct {
+	path    string
+	file    *os.File
+	mu      sync.Mutex
+	prefix  string
+	counter uint64
+	pending map[string]bool
+}
+
+func newJournal(path string) *journal {
+	return &journal{
+		path:    path,
+		prefix:  fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid()),
+		pending: make(map[string]bool),
+	}
+}
+
+// write appends an entry to the journal, syncing it if requested
+func (j *journal) write(entry JournalEntry, sync bool) error {
+	if j.file == nil {
+		f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.file = f
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// begin records an operation about to start and returns its ID
+func (j *journal) begin(op JournalOp, hash, path string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.counter++
+	id := fmt.Sprintf("%s-%d", j.prefix, j.counter)
+	err := j.write(JournalEntry{ID: id, Op: op, Hash: hash, Path: path}, true)
+	if err != nil {
+		return "", err
+	}
+
+	j.pending[id] = true
+	return id, nil
+}
+
+// commit marks the operation with the given ID as done. The journal is only
+// emptied by the recovery, which sees the entries of every process
+func (j *journal) commit(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.pending, id)
+	return j.write(JournalEntry{ID: id, Done: true}, false)
+}
+
+// isPending checks if the operation with the given ID was started by this
+// process and is still in progress
+func (j *journal) isPending(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.pending[id]
+}
+
+// clear empties the journal, unless this process has operations in progress
+func (j *journal) clear() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) > 0 {
+		return nil
+	}
+
+	err := os.Truncate(j.path, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// read returns the entries of the journal which were never marked as done
+func (j *journal) read() ([]JournalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	entries := make(map[string]JournalEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		// A crash can leave a partially written last line, skip it
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		if entry.Done {
+			delete(entries, entry.ID)
+			continue
+		}
+
+		entries[entry.ID] = entry
+		order = append(order, entry.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []JournalEntry
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			pending = append(pending, entry)
+		}
+	}
+
+	return pending, nil
+}
+
+// Recover replays or rolls back the operations left half-finished in the
+// journal by an interrupted run and returns what has been done about them
+func (s *Storage) Recover() ([]RecoveryAction, error) {
+	lockFile, actions, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	return actions, nil
+}
+
+// tryRecover runs the recovery only if nobody else holds the storage lock,
+// as pending entries of a running process are not half-finished
+func (s *Storage) tryRecover() ([]RecoveryAction, error) {
+	lockFile, err := os.OpenFile(filepath.Join(s.Opts.Root, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	return s.recoverJournal()
+}
+
+// recoverJournal fixes the pending journal entries, the caller must hold the
+// storage lock
+func (s *Storage) recoverJournal() ([]RecoveryAction, error) {
+	pending, err := s.journal.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []RecoveryAction
+	for _, entry := range pending {
+		// The operations of this process are not half-finished
+		if s.journal.isPending(entry.ID) {
+			continue
+		}
+
+		action := RecoveryAction{Entry: entry}
+
+		objectPath, objectExists, err := s.FindObject(entry.Hash)
+		if err != nil {
+			return actions, err
+		}
+
+		pathExists, err := s.FileExists(entry.Path)
+		if err != nil {
+			return actions, err
+		}
+
+		switch {
+		case !pathExists && objectExists:
+			// The path was moved or removed but never linked, roll forward
+			err = s.CreateLink(objectPath, entry.Path)
+			if err == nil {
+				err = s.AddReference(entry.Hash, entry.Path)
+			}
+			action.Action = "relinked"
+		case pathExists && objectExists:
+			// The path is only complete once linked, a replace interrupted
+			// before removing it leaves an independent file behind
+			info, lstatErr := os.Lstat(entry.Path)
+			if lstatErr != nil || !s.IsLinked(entry.Path, info, entry.Hash) {
+				action.Action = "rolled-back"
+				break
+			}
+			err = s.AddReference(entry.Hash, entry.Path)
+			action.Action = "completed"
+		case pathExists:
+			// The rename never happened, nothing to undo
+			action.Action = "rolled-back"
+		default:
+			action.Action = "lost"
+		}
+		if err != nil {
+			action.Error = err.Error()
+		}
+
+		actions = append(actions, action)
+	}
+
+	if len(actions) > 0 {
+		err = s.index.Save()
+		if err != nil {
+			return actions, err
+		}
+	}
+
+	return actions, s.journal.clear()
+}
+
+// ReplaceFile replaces the file at the given path with a link to the object
+// with the given hash, the operation is journaled so that an interruption
+// between the removal and the link can be recovered
+func (s *Storage) ReplaceFile(path, hash string) error {
+	objectPath, exists, err := s.FindObject(hash)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("object %s not found: %w", hash, os.ErrNotExist)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	id, err := s.journal.begin(JournalReplace, hash, absPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		// Nothing has been touched, the entry can be closed
+		s.journal.commit(id)
+		return err
+	}
+
+	err = s.CreateLink(objectPath, path)
+	if err != nil {
+		return err
+	}
+
+	err = s.AddReference(hash, path)
+	if err != nil {
+		return err
+	}
+
+	return s.journal.commit(id)
+}
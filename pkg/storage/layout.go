@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Layout describes how objects are fanned out in the storage root, e.g. a
+// layout with Depth 2 and Width 2 stores the object "abcdef…" under
+// "ab/cd/abcdef…". The zero value is the flat layout, where every object
+// lives directly in the storage root
+type Layout struct {
+	// Depth is the number of directory levels used to shard the objects
+	Depth int
+
+	// Width is the number of hash characters used for each level
+	Width int
+}
+
+// IsFlat reports whether the layout stores objects directly in the root
+func (l Layout) IsFlat() bool {
+	return l.Depth <= 0 || l.Width <= 0
+}
+
+// Validate checks that the layout can be used to shard the objects
+func (l Layout) Validate() error {
+	if l.Depth < 0 || l.Width < 0 {
+		return fmt.Errorf("invalid layout %s: depth and width must not be negative", l)
+	}
+
+	if l.Depth*l.Width > 16 {
+		return fmt.Errorf("invalid layout %s: depth*width must not exceed 16", l)
+	}
+
+	return nil
+}
+
+// ParseLayout parses a layout in the form returned by String, like 2x2 or
+// flat
+func ParseLayout(s string) (Layout, error) {
+	if s == "" || s == "flat" {
+		return Layout{}, nil
+	}
+
+	var l Layout
+	var rest string
+	n, _ := fmt.Sscanf(s, "%dx%d%s", &l.Depth, &l.Width, &rest)
+	if n != 2 {
+		return Layout{}, fmt.Errorf("invalid layout %q: expected <depth>x<width> or flat", s)
+	}
+
+	return l, l.Validate()
+}
+
+// String returns a human readable representation of the layout
+func (l Layout) String() string {
+	if l.IsFlat() {
+		return "flat"
+	}
+	return fmt.Sprintf("%dx%d", l.Depth, l.Width)
+}
+
+// objectPath returns the path of the object with the given name inside root
+func (l Layout) objectPath(root, name string) string {
+	if l.IsFlat() || len(name) < l.Depth*l.Width {
+		return filepath.Join(root, name)
+	}
+
+	parts := []string{root}
+	for i := 0; i < l.Depth; i++ {
+		parts = append(parts, name[i*l.Width:(i+1)*l.Width])
+	}
+	parts = append(parts, name)
+
+	return filepath.Join(parts...)
+}
+
+// ObjectPath returns the path of the object with the given hash according
+// to the storage layout
+func (s *Storage) ObjectPath(hash string) string {
+	return s.Opts.Layout.objectPath(s.Opts.Root, hash)
+}
+
+// FindObject returns the path of the object with the given hash and whether
+// it exists. While a layout migration is in progress, the previous location
+// is checked too, if the object does not exist the path according to the
+// current layout is returned
+func (s *Storage) FindObject(hash string) (string, bool, error) {
+	objectPath := s.ObjectPath(hash)
+	exists, err := s.FileExists(objectPath)
+	if err != nil || exists {
+		return objectPath, exists, err
+	}
+
+	if s.Opts.PreviousLayout != nil {
+		previousPath := s.Opts.PreviousLayout.objectPath(s.Opts.Root, hash)
+		exists, err := s.FileExists(previousPath)
+		if err != nil || exists {
+			return previousPath, exists, err
+		}
+	}
+
+	return objectPath, false, nil
+}
+
+// walkObjects calls fn for each object in the storage, skipping the storage's
+// own files and directories (the ones starting with a dot)
+func (s *Storage) walkObjects(fn func(path string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(s.Opts.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == s.Opts.Root {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		return fn(path, d)
+	})
+}
+
+// MigrateLayout moves every object to the location given by the new layout.
+// Objects are renamed in place so existing hardlinks are preserved, while
+// the indexed symlinks are rewritten to the new locations. The new layout is
+// recorded before moving anything, together with the previous one, so an
+// interrupted migration can be resumed by calling MigrateLayout again and
+// objects are still found in the meantime
+func (s *Storage) MigrateLayout(layout Layout) (moved int, err error) {
+	if err := layout.Validate(); err != nil {
+		return 0, err
+	}
+
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	if s.Opts.PreviousLayout == nil {
+		if layout == s.Opts.Layout {
+			return 0, nil
+		}
+		previous := s.Opts.Layout
+		s.Opts.PreviousLayout = &previous
+	} else if layout != s.Opts.Layout {
+		return 0, fmt.Errorf("a migration to the %s layout is in progress, resume it first", s.Opts.Layout)
+	}
+
+	s.Opts.Layout = layout
+	err = s.updateOpts(s.Opts)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.walkObjects(func(path string, d fs.DirEntry) error {
+		target := s.ObjectPath(d.Name())
+		if target != path {
+			err := os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return err
+			}
+
+			err = os.Rename(path, target)
+			if err != nil {
+				return err
+			}
+
+			moved++
+		}
+
+		// Checked for objects already in place too, in case a previous
+		// migration was interrupted before rewriting their symlinks
+		return s.relinkSymlinks(d.Name(), target)
+	})
+	if err != nil {
+		return moved, err
+	}
+
+	err = s.removeEmptyDirs()
+	if err != nil {
+		return moved, err
+	}
+
+	s.Opts.PreviousLayout = nil
+	return moved, s.updateOpts(s.Opts)
+}
+
+// relinkSymlinks points the indexed symlinks to the object with the given
+// hash, which still point to another location in the storage, to the given
+// object path
+func (s *Storage) relinkSymlinks(hash, objectPath string) error {
+	if s.Opts.LinkMode != LinkSymlink {
+		return nil
+	}
+
+	root, err := filepath.Abs(s.Opts.Root)
+	if err != nil {
+		return err
+	}
+
+	absObjectPath, err := filepath.Abs(objectPath)
+	if err != nil {
+		return err
+	}
+
+	entry, _ := s.index.Get(hash)
+	for _, path := range entry.Paths {
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+
+		if target == absObjectPath || filepath.Base(target) != hash || !isSubPath(root, target) {
+			continue
+		}
+
+		// Replace the symlink atomically, so the path never goes missing
+		tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		os.Remove(tmpPath)
+		err = s.CreateLink(objectPath, tmpPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tmpPath, path)
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeEmptyDirs removes the shard directories left empty by a migration
+func (s *Storage) removeEmptyDirs() error {
+	var dirs []string
+	err := filepath.WalkDir(s.Opts.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == s.Opts.Root || !d.IsDir() {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk backwards so that children are removed before their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			err = os.Remove(dirs[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
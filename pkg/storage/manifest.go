@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FileMetadata is the metadata of a path before it was deduplicated
+type FileMetadata struct {
+	Mode    os.FileMode `json:"mode"`
+	Uid     int         `json:"uid"`
+	Gid     int         `json:"gid"`
+	ModTime int64       `json:"mod_time"`
+}
+
+// ManifestEntry describes a deduplicated path
+type ManifestEntry struct {
+	Hash     string        `json:"hash"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+}
+
+// Manifest maps deduplicated paths to their entries
+type Manifest map[string]ManifestEntry
+
+// NewFileMetadata returns the metadata described by the given file info
+func NewFileMetadata(info os.FileInfo) FileMetadata {
+	metadata := FileMetadata{
+		Mode:    info.Mode(),
+		ModTime: info.ModTime().Unix(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		metadata.Uid = int(stat.Uid)
+		metadata.Gid = int(stat.Gid)
+	}
+
+	return metadata
+}
+
+// LoadManifest reads a manifest written by dedup, both the plain format
+// mapping each path to its hash and the one with per-path metadata are
+// supported
+func LoadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make(Manifest, len(raw))
+	for p, value := range raw {
+		var entry ManifestEntry
+		if err := json.Unmarshal(value, &entry.Hash); err != nil {
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return nil, err
+			}
+		}
+		manifest[p] = entry
+	}
+
+	return manifest, nil
+}
+
+// applyMetadata applies the given metadata to the file at the given path,
+// ownership is only changed when allowed to
+func applyMetadata(path string, metadata FileMetadata) error {
+	err := os.Lchown(path, metadata.Uid, metadata.Gid)
+	if err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	err = os.Chmod(path, metadata.Mode)
+	if err != nil {
+		return err
+	}
+
+	modTime := time.Unix(metadata.ModTime, 0)
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// MaterializeOptions are the options for Materialize
+type MaterializeOptions struct {
+	// Manifest, when set, is used to restore the metadata each path had
+	// before being deduplicated
+	Manifest Manifest
+
+	// GC removes the objects left without references
+	GC bool
+}
+
+// MaterializeReport describes what Materialize did
+type MaterializeReport struct {
+	// Materialized holds the paths turned into independent files
+	Materialized []string `json:"materialized"`
+
+	// Removed holds the objects removed because left without references
+	Removed []string `json:"removed"`
+}
+
+// Materialize breaks the links to the storage found under the given path,
+// replacing each of them with an independent copy of its object. Paths are
+// replaced atomically, so they are never seen missing or partially written
+func (s *Storage) Materialize(path string, opts MaterializeOptions) (*MaterializeReport, error) {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a complete index, objects are looked up by inode
+	var byInode map[uint64]string
+	if !s.index.Complete {
+		byInode, err = s.objectsByInode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Manifests may hold relative paths
+	metadata := make(map[string]FileMetadata)
+	for p, entry := range opts.Manifest {
+		if entry.Metadata == nil {
+			continue
+		}
+
+		absP, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		metadata[absP] = *entry.Metadata
+	}
+
+	report := &MaterializeReport{}
+	touched := make(map[string]bool)
+
+	err = filepath.Walk(absPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if IsStorageRoot(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		hash, ok := s.linkedObject(p, info, byInode)
+		if !ok {
+			return nil
+		}
+
+		objectPath, exists, err := s.FindObject(hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		// Reflinks already are independent files, only hardlinks and
+		// symlinks need a copy
+		objectInfo, err := os.Stat(objectPath)
+		if err != nil {
+			return err
+		}
+
+		err = s.index.markDirty()
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 || os.SameFile(info, objectInfo) {
+			err = copyFile(objectPath, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		if m, ok := metadata[p]; ok {
+			err = applyMetadata(p, m)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.index.removeRef(p)
+		touched[hash] = true
+		report.Materialized = append(report.Materialized, p)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// The registered paths under the materialized one are not linked anymore
+	for _, registered := range append([]string{}, s.Opts.Paths...) {
+		absRegistered, err := filepath.Abs(registered)
+		if err != nil {
+			return report, err
+		}
+
+		if isSubPath(absPath, absRegistered) {
+			err = s.removeStoredPath(registered)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if opts.GC {
+		for hash := range touched {
+			objectPath, exists, err := s.FindObject(hash)
+			if err != nil {
+				return report, err
+			}
+			if !exists {
+				continue
+			}
+
+			links, err := s.FindLinks(objectPath, nil)
+			if err != nil {
+				return report, err
+			}
+
+			if len(links) == 0 {
+				err = s.removeFile(objectPath)
+				if err != nil {
+					return report, err
+				}
+				report.Removed = append(report.Removed, objectPath)
+			}
+		}
+	}
+
+	return report, s.index.Save()
+}
+
+// linkedObject returns the hash of the object the given path is linked to
+func (s *Storage) linkedObject(path string, info os.FileInfo, byInode map[uint64]string) (string, bool) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		targetInfo, ok := s.resolveLink(path)
+		if !ok {
+			return "", false
+		}
+		info = targetInfo
+	} else if !info.Mode().IsRegular() {
+		return "", false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+
+	if byInode != nil {
+		hash, ok := byInode[stat.Ino]
+		return hash, ok
+	}
+
+	hash, ok := s.index.Lookup(path, stat.Ino)
+	if !ok {
+		return "", false
+	}
+
+	objectPath, exists, err := s.FindObject(hash)
+	if err != nil || !exists {
+		return "", false
+	}
+
+	objectInfo, err := os.Lstat(objectPath)
+	if err != nil {
+		return "", false
+	}
+
+	if !os.SameFile(info, objectInfo) && !s.isLinkOf(path, info, hash, objectPath, objectInfo) {
+		return "", false
+	}
+
+	return hash, true
+}
+
+// objectsByInode maps the inode of every object to its hash
+func (s *Storage) objectsByInode() (map[uint64]string, error) {
+	byInode := make(map[uint64]string)
+	err := s.walkObjects(func(path string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			byInode[stat.Ino] = d.Name()
+		}
+
+		return nil
+	})
+
+	return byInode, err
+}
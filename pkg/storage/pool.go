@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// DefaultPoolDir is where a Pool keeps the storage of each device, relative
+// to the device mount point
+const DefaultPoolDir = ".dabadee/Storage"
+
+// Pool picks a storage for each mounted device, creating it if needed, so
+// that files living on different filesystems can be deduplicated in one run
+type Pool struct {
+	// Dir is the path of each storage relative to the mount point of its
+	// device
+	Dir string
+
+	// Opts are the options used to create the storages, Root is ignored
+	Opts StorageOptions
+
+	mu       sync.Mutex
+	storages map[uint64]*Storage
+}
+
+// NewPool creates a new Pool keeping the storages in the given directory of
+// each mount point
+func NewPool(dir string, opts StorageOptions) *Pool {
+	return &Pool{
+		Dir:      dir,
+		Opts:     opts,
+		storages: make(map[uint64]*Storage),
+	}
+}
+
+// ForPath returns the storage for the device holding the given path
+func (p *Pool) ForPath(path string) (*Storage, error) {
+	dev, err := DeviceOf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.storages[dev]; ok {
+		return s, nil
+	}
+
+	mountPoint, err := findMountPoint(path, dev)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := p.Opts
+	opts.Root = filepath.Join(mountPoint, p.Dir)
+	s, err := NewStorage(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.storages[dev] = s
+	return s, nil
+}
+
+// Storages returns the storages opened so far
+func (p *Pool) Storages() []*Storage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var storages []*Storage
+	for _, s := range p.storages {
+		storages = append(storages, s)
+	}
+
+	return storages
+}
+
+// findMountPoint returns the topmost directory containing path which is still
+// on the given device
+func findMountPoint(path string, dev uint64) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	mountPoint := absPath
+	for {
+		parent := filepath.Dir(mountPoint)
+		if parent == mountPoint {
+			return mountPoint, nil
+		}
+
+		info, err := os.Stat(parent)
+		if err != nil {
+			return "", err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return "", os.ErrInvalid
+		}
+
+		if uint64(stat.Dev) != dev {
+			return mountPoint, nil
+		}
+		mountPoint = parent
+	}
+}
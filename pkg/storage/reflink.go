@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, which makes the destination file
+// share the extents of the source one on copy-on-write filesystems
+const ficlone = 0x40049409
+
+// reflink creates a copy-on-write clone of the source file at the destination
+// path, carrying over the source permissions, ownership and times
+func reflink(sourcePath, destPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dest.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		dest.Close()
+		os.Remove(destPath)
+		return &os.LinkError{Op: "reflink", Old: sourcePath, New: destPath, Err: errno}
+	}
+
+	err = dest.Close()
+	if err != nil {
+		return err
+	}
+
+	return CopyAttributes(destPath, info)
+}
+
+// isReflinkUnsupported checks if the error means that the filesystem cannot
+// clone files, as opposed to a failure of the clone itself
+func isReflinkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOTTY) ||
+		errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EXDEV)
+}
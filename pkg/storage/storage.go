@@ -2,6 +2,9 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,8 +15,43 @@ import (
 type Storage struct {
 	// Opts are the options for the storage
 	Opts StorageOptions
+
+	// index keeps track of the objects and the paths referencing them
+	index *Index
+
+	// journal records the operations in progress to recover from crashes
+	journal *journal
+
+	// configStamp identifies the config file last loaded or saved, to tell
+	// whether another process has changed it since
+	configStamp fileStamp
+
+	// Recovered holds what was done about the operations left half-finished
+	// by an interrupted run, recovered automatically when opening or locking
+	// the storage
+	Recovered []RecoveryAction
 }
 
+// LinkMode is the way deduplicated paths are linked to the stored objects
+type LinkMode string
+
+const (
+	// LinkHardlink links paths to objects with hardlinks, sharing the inode
+	LinkHardlink LinkMode = "hardlink"
+
+	// LinkReflink makes paths copy-on-write clones of the objects, so each
+	// path keeps its own inode and metadata while sharing the data
+	LinkReflink LinkMode = "reflink"
+
+	// LinkAuto uses reflinks where the filesystem supports them and falls
+	// back to hardlinks elsewhere
+	LinkAuto LinkMode = "auto"
+
+	// LinkSymlink replaces paths with symlinks to the objects, which works
+	// across filesystems
+	LinkSymlink LinkMode = "symlink"
+)
+
 // StorageOptions are the options for the storage
 type StorageOptions struct {
 	// Root is the base path of the storage
@@ -24,10 +62,36 @@ type StorageOptions struct {
 
 	// Paths holds the parent paths used during the deduplication process
 	Paths []string
+
+	// Layout is the fan-out layout used to store the objects
+	Layout Layout
+
+	// PreviousLayout holds the layout being migrated from, it is nil unless
+	// a layout migration is in progress
+	PreviousLayout *Layout
+
+	// LinkMode is the way paths are linked to the objects, hardlinks are
+	// used if empty
+	LinkMode LinkMode
+
+	// RelativeSymlinks makes the symlinks relative to their location rather
+	// than absolute, used with the symlink link mode
+	RelativeSymlinks bool
 }
 
 // NewStorage creates a new Storage
 func NewStorage(opts StorageOptions) (storage *Storage, err error) {
+	err = opts.Layout.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.LinkMode {
+	case "", LinkHardlink, LinkReflink, LinkAuto, LinkSymlink:
+	default:
+		return nil, fmt.Errorf("invalid link mode: %s", opts.LinkMode)
+	}
+
 	// Check if storage directory exists
 	_, err = os.Stat(opts.Root)
 	if err != nil {
@@ -44,10 +108,14 @@ func NewStorage(opts StorageOptions) (storage *Storage, err error) {
 
 	configFilePath := filepath.Join(opts.Root, ".dabadee")
 
-	// Check if the config file exists
+	// Check if the config file exists, a new storage starts with a complete
+	// index, while one created before the index existed needs a rebuild
+	created := false
 	_, err = os.Stat(configFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			created = true
+
 			// No config file found, so create it
 			optsFile, err := os.Create(configFilePath)
 			if err != nil {
@@ -75,10 +143,52 @@ func NewStorage(opts StorageOptions) (storage *Storage, err error) {
 		}
 	}
 
-	storage = &Storage{Opts: opts}
+	index, err := loadIndex(filepath.Join(opts.Root, ".index"), created)
+	if err != nil {
+		return nil, err
+	}
+
+	storage = &Storage{
+		Opts:    opts,
+		index:   index,
+		journal: newJournal(filepath.Join(opts.Root, ".journal")),
+	}
+	if info, err := os.Stat(configFilePath); err == nil {
+		storage.configStamp = newFileStamp(info)
+	}
+
+	storage.Recovered, err = storage.tryRecover()
+	if err != nil {
+		return nil, err
+	}
+
 	return storage, nil
 }
 
+// ErrNotStorage is the error of opening a path holding no storage
+var ErrNotStorage = errors.New("not a storage")
+
+// OpenStorage opens the existing storage at the given root, unlike NewStorage
+// it fails with ErrNotStorage rather than creating a missing one
+func OpenStorage(root string) (*Storage, error) {
+	err := CheckStorage(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStorage(StorageOptions{Root: root})
+}
+
+// CheckStorage checks that the given root holds a storage, failing with
+// ErrNotStorage if not
+func CheckStorage(root string) error {
+	_, err := os.Stat(filepath.Join(root, ".dabadee"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", root, ErrNotStorage)
+	}
+	return err
+}
+
 func loadConfig(root string) (StorageOptions, error) {
 	optsFile, err := os.Open(filepath.Join(root, ".dabadee"))
 	if err != nil {
@@ -112,15 +222,53 @@ func (s *Storage) MoveFileToStorage(sourcePath, destHash string) error {
 		return nil
 	}
 
-	// move the file to the storage
-	destPath := filepath.Join(s.Opts.Root, destHash)
+	// move the file to the storage, journaling the operation so that the
+	// source path can be restored if we crash before linking it back
+	destPath := s.ObjectPath(destHash)
+	err = os.MkdirAll(filepath.Dir(destPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	absSourcePath, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	id, err := s.journal.begin(JournalMove, destHash, absSourcePath)
+	if err != nil {
+		return err
+	}
+
 	err = os.Rename(sourcePath, destPath)
+	if errors.Is(err, syscall.EXDEV) && s.Opts.LinkMode == LinkSymlink {
+		// Symlinks can cross filesystems, copy the file over instead
+		err = copyFile(sourcePath, destPath)
+		if err == nil {
+			err = os.Remove(sourcePath)
+		}
+	}
 	if err != nil {
+		if _, statErr := os.Lstat(sourcePath); statErr == nil {
+			// The source is still in place, the entry can be closed
+			s.journal.commit(id)
+		}
 		return err
 	}
 
 	// link the file to the source path
-	err = os.Link(destPath, sourcePath)
+	err = s.CreateLink(destPath, sourcePath)
+	if err != nil {
+		return err
+	}
+
+	// index the new object and its first reference
+	err = s.AddReference(destHash, sourcePath)
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.commit(id)
 	if err != nil {
 		return err
 	}
@@ -135,9 +283,146 @@ func (s *Storage) MoveFileToStorage(sourcePath, destHash string) error {
 	return nil
 }
 
-// CreateLink creates a link at the given path pointing to the target path
+// CreateLink creates a link at the given path pointing to the target path,
+// according to the link mode of the storage
 func (s *Storage) CreateLink(targetPath, linkPath string) error {
-	return os.Link(targetPath, linkPath)
+	// The index does not know the link until it is saved
+	err := s.index.markDirty()
+	if err != nil {
+		return err
+	}
+
+	switch s.Opts.LinkMode {
+	case LinkReflink:
+		return reflink(targetPath, linkPath)
+	case LinkAuto:
+		err := reflink(targetPath, linkPath)
+		if err != nil && isReflinkUnsupported(err) {
+			return os.Link(targetPath, linkPath)
+		}
+		return err
+	case LinkSymlink:
+		absTargetPath, err := filepath.Abs(targetPath)
+		if err != nil {
+			return err
+		}
+
+		if s.Opts.RelativeSymlinks {
+			absLinkPath, err := filepath.Abs(linkPath)
+			if err != nil {
+				return err
+			}
+
+			absTargetPath, err = filepath.Rel(filepath.Dir(absLinkPath), absTargetPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		return os.Symlink(absTargetPath, linkPath)
+	default:
+		return os.Link(targetPath, linkPath)
+	}
+}
+
+// usesReflinks checks if paths may be reflinked to the objects, in which
+// case they cannot be matched by inode and the index is used instead
+func (s *Storage) usesReflinks() bool {
+	return s.Opts.LinkMode == LinkReflink || s.Opts.LinkMode == LinkAuto
+}
+
+// usesHardlinksOnly checks if every path is hardlinked to its object, so
+// that the link count of the object tells how many paths reference it
+func (s *Storage) usesHardlinksOnly() bool {
+	return s.Opts.LinkMode == "" || s.Opts.LinkMode == LinkHardlink
+}
+
+// CheckLinkable checks that the given paths can be linked to the objects,
+// which requires them to be on the storage filesystem unless symlinks are
+// used
+func (s *Storage) CheckLinkable(paths ...string) error {
+	if s.Opts.LinkMode == LinkSymlink {
+		return nil
+	}
+
+	return s.CheckSameDevice(paths...)
+}
+
+// resolveLink returns the info of the file the given symlink points to, as
+// long as it lives in the storage
+func (s *Storage) resolveLink(path string) (os.FileInfo, bool) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, false
+	}
+
+	root, err := filepath.EvalSymlinks(s.Opts.Root)
+	if err != nil || !isSubPath(root, target) {
+		return nil, false
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, false
+	}
+
+	return info, true
+}
+
+// IsStorageLink checks if the given path is a symlink to a file in the
+// storage
+func (s *Storage) IsStorageLink(path string) bool {
+	_, ok := s.resolveLink(path)
+	return ok
+}
+
+// IsLinked checks if the file at the given path, described by info, is linked
+// to the object with the given hash. Hardlinks share the object inode, while
+// reflinks are recognized through the index
+func (s *Storage) IsLinked(path string, info os.FileInfo, hash string) bool {
+	objectPath, exists, err := s.FindObject(hash)
+	if err != nil || !exists {
+		return false
+	}
+
+	objectInfo, err := os.Lstat(objectPath)
+	if err != nil {
+		return false
+	}
+
+	return s.isLinkOf(path, info, hash, objectPath, objectInfo)
+}
+
+// isLinkOf checks if the file at the given path is linked to the object with
+// the given hash, path and info
+func (s *Storage) isLinkOf(path string, info os.FileInfo, hash, objectPath string, objectInfo os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		targetInfo, ok := s.resolveLink(path)
+		return ok && os.SameFile(targetInfo, objectInfo)
+	}
+
+	if os.SameFile(info, objectInfo) {
+		return true
+	}
+
+	if !s.usesReflinks() || !info.Mode().IsRegular() || info.Size() != objectInfo.Size() {
+		return false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	refHash, ok := s.index.lookupPath(absPath)
+	if !ok || refHash != hash {
+		return false
+	}
+
+	// The index may be behind a file rewritten in place, which keeps its path
+	// but no longer shares the object content
+	same, err := SameContent(path, objectPath)
+	return err == nil && same
 }
 
 // FileExists checks if the file at the given path exists
@@ -149,11 +434,12 @@ func (s *Storage) FileExists(filePath string) (bool, error) {
 	return err == nil, err
 }
 
-// FindHardLinks finds all hard links to the specified file path, it searches
-// the stored paths by default, additional paths can be specified to extend
-// the search
+// FindLinks finds all hard links to the specified file path, it looks them up
+// in the index or searches the stored paths if the index does not know the
+// file, additional paths can be specified to extend the search
 func (s *Storage) FindLinks(filePath string, additionalPaths []string) ([]string, error) {
 	var links []string
+	found := make(map[string]bool)
 
 	info, err := os.Stat(filePath)
 	if err != nil {
@@ -172,15 +458,52 @@ func (s *Storage) FindLinks(filePath string, additionalPaths []string) ([]string
 			return nil
 		}
 
+		// Symlinks into the storage are matched against their target
+		if d.Mode()&os.ModeSymlink != 0 {
+			targetInfo, ok := s.resolveLink(path)
+			if !ok {
+				return nil
+			}
+			d = targetInfo
+		}
+
 		dStat, ok := d.Sys().(*syscall.Stat_t)
-		if ok && dStat.Ino == inode {
+		if ok && dStat.Ino == inode && !found[path] {
+			found[path] = true
 			links = append(links, path)
 		}
 
 		return nil
 	}
 
-	paths := append(s.Opts.Paths, additionalPaths...)
+	paths := additionalPaths
+	if hash, ok := s.lookupIndex(filePath, inode); ok {
+		// Reflinks have their own inode, so they are matched against the
+		// object found in the index
+		objectPath, _, err := s.FindObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		objectInfo, err := os.Lstat(objectPath)
+		if err != nil {
+			objectInfo = info
+		}
+
+		entry, _ := s.index.Get(hash)
+		for _, ref := range entry.Paths {
+			refInfo, err := os.Lstat(ref)
+			if err != nil {
+				continue
+			}
+			if !found[ref] && s.isLinkOf(ref, refInfo, hash, objectPath, objectInfo) {
+				found[ref] = true
+				links = append(links, ref)
+			}
+		}
+	} else {
+		paths = append(append([]string{}, s.Opts.Paths...), additionalPaths...)
+	}
+
 	for _, path := range paths {
 		err = filepath.Walk(path, searchFunc)
 		if err != nil {
@@ -209,9 +532,34 @@ func (s *Storage) updateOpts(opts StorageOptions) error {
 		return err
 	}
 
+	if info, err := optsFile.Stat(); err == nil {
+		s.configStamp = newFileStamp(info)
+	}
 	return nil
 }
 
+// reload replaces the config and the index in memory with the ones on disk
+// if another process has saved them since they were last loaded or saved,
+// the caller must hold the storage lock
+func (s *Storage) reload() error {
+	info, err := os.Stat(filepath.Join(s.Opts.Root, ".dabadee"))
+	if err != nil {
+		return err
+	}
+
+	if stamp := newFileStamp(info); stamp != s.configStamp {
+		opts, err := loadConfig(s.Opts.Root)
+		if err != nil {
+			return fmt.Errorf("reloading config: %w", err)
+		}
+		opts.Root = s.Opts.Root
+		s.Opts = opts
+		s.configStamp = stamp
+	}
+
+	return s.index.reload()
+}
+
 // storeNewPath stores the parent path of the file
 func (s *Storage) storeNewPath(path string) error {
 	// Check if the path is already stored
@@ -239,7 +587,24 @@ func (s *Storage) removeStoredPath(path string) error {
 }
 
 // RemoveFile removes a file from the storage and all its links.
-func (s *Storage) RemoveFile(path string) (err error) {
+func (s *Storage) RemoveFile(path string) error {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	err = s.removeFile(path)
+	if err != nil {
+		return err
+	}
+
+	return s.index.Save()
+}
+
+// removeFile removes a file from the storage and all its links, without
+// saving the index
+func (s *Storage) removeFile(path string) (err error) {
 	ok := s.isStoredPath(path)
 	if !ok {
 		path, err = s.findStoredPath(path)
@@ -253,6 +618,11 @@ func (s *Storage) RemoveFile(path string) (err error) {
 		return err
 	}
 
+	err = s.index.markDirty()
+	if err != nil {
+		return err
+	}
+
 	for _, link := range links {
 		err = os.Remove(link)
 		if err != nil {
@@ -265,9 +635,34 @@ func (s *Storage) RemoveFile(path string) (err error) {
 		return err
 	}
 
+	s.index.remove(filepath.Base(path))
 	return nil
 }
 
+// lookupIndex returns the hash of the object linked at the given path, as long
+// as the index is complete and knows it
+func (s *Storage) lookupIndex(path string, inode uint64) (string, bool) {
+	if !s.index.Complete {
+		return "", false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	return s.index.Lookup(absPath, inode)
+}
+
+// isSubPath checks if path is dir or lives under it
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // isStoredPath checks if the path is stored
 func (s *Storage) isStoredPath(path string) bool {
 	absStorePath, err := filepath.Abs(s.Opts.Root)
@@ -298,21 +693,32 @@ func (s *Storage) findStoredPath(path string) (string, error) {
 
 	inode := stat.Ino
 
-	searchFunc := func(p string, d os.FileInfo, err error) error {
+	if hash, ok := s.lookupIndex(path, inode); ok {
+		objectPath, exists, err := s.FindObject(hash)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return objectPath, nil
+		}
+	}
+
+	searchFunc := func(p string, d fs.DirEntry) error {
+		dInfo, err := d.Info()
 		if err != nil {
 			return nil
 		}
 
-		dStat, ok := d.Sys().(*syscall.Stat_t)
+		dStat, ok := dInfo.Sys().(*syscall.Stat_t)
 		if ok && dStat.Ino == inode {
 			path = p
-			return filepath.SkipDir
+			return filepath.SkipAll
 		}
 
 		return nil
 	}
 
-	err = filepath.Walk(s.Opts.Root, searchFunc)
+	err = s.walkObjects(searchFunc)
 	if err != nil {
 		return "", err
 	}
@@ -322,40 +728,61 @@ func (s *Storage) findStoredPath(path string) (string, error) {
 
 // RemoveOrphans removes all files that are not linked to any other file
 func (s *Storage) RemoveOrphans() error {
-	// Get all files in the storage
-	files, err := s.ListFiles()
+	lockFile, err := s.AcquireLock()
 	if err != nil {
 		return err
 	}
+	defer s.ReleaseLock(lockFile)
 
-	// Check if the file is linked to any other file
-	for _, file := range files {
-		if file.Name() == ".dabadee" {
-			continue
-		}
+	// Get all objects in the storage
+	var objects []string
+	err = s.walkObjects(func(path string, d fs.DirEntry) error {
+		objects = append(objects, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		links, err := s.FindLinks(filepath.Join(s.Opts.Root, file.Name()), nil)
+	// Check if the object is linked to any other file
+	for _, object := range objects {
+		links, err := s.FindLinks(object, nil)
 		if err != nil {
 			return err
 		}
 
 		if len(links) == 0 {
-			err = s.RemoveFile(filepath.Join(s.Opts.Root, file.Name()))
+			err = s.removeFile(object)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	err = s.index.Save()
+	if err != nil {
+		return err
+	}
+
 	// Check if the registered paths have still at least one linked file
-	for _, path := range s.Opts.Paths {
+	for _, path := range append([]string{}, s.Opts.Paths...) {
 		var links []string
 
 		_, err := os.Stat(path)
 		if err == nil {
-			links, err = s.FindLinks(path, nil)
-			if err != nil {
-				return err
+			if s.index.Complete {
+				absPath, err := filepath.Abs(path)
+				if err != nil {
+					return err
+				}
+				if s.index.hasRefUnder(absPath) {
+					continue
+				}
+			} else {
+				links, err = s.FindLinks(path, nil)
+				if err != nil {
+					return err
+				}
 			}
 		}
 
@@ -371,36 +798,59 @@ func (s *Storage) RemoveOrphans() error {
 	return nil
 }
 
-// ListFiles returns the list of files in the storage
+// ListFiles returns the list of files in the storage, looking into the shard
+// directories of the layout
 func (s *Storage) ListFiles() ([]os.DirEntry, error) {
-	dir, err := os.ReadDir(s.Opts.Root)
+	var files []os.DirEntry
+	err := s.walkObjects(func(path string, d fs.DirEntry) error {
+		files = append(files, d)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var files []os.DirEntry
-	for _, file := range dir {
-		if file.Name() != ".dabadee" && file.Name() != ".dedup_cache" && file.Name() != ".lock" {
-			files = append(files, file)
-		}
-	}
-
 	return files, nil
 }
 
 // AcquireLock obtains an exclusive lock on the storage to avoid concurrent modifications.
+// The config and the index are reloaded if another process has saved them
+// meanwhile, so that saving them again does not drop their changes, and the
+// operations left half-finished by a process which crashed meanwhile are
+// recovered, adding to Recovered
 func (s *Storage) AcquireLock() (*os.File, error) {
+	f, actions, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Recovered = append(s.Recovered, actions...)
+	return f, nil
+}
+
+// lock is AcquireLock, returning what was recovered instead of recording it
+func (s *Storage) lock() (*os.File, []RecoveryAction, error) {
 	lockPath := filepath.Join(s.Opts.Root, ".lock")
 	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
 	if err != nil {
 		f.Close()
-		return nil, err
+		return nil, nil, err
 	}
-	return f, nil
+	err = s.reload()
+	if err != nil {
+		s.ReleaseLock(f)
+		return nil, nil, err
+	}
+	actions, err := s.recoverJournal()
+	if err != nil {
+		s.ReleaseLock(f)
+		return nil, nil, err
+	}
+	return f, actions, nil
 }
 
 // ReleaseLock releases the previously acquired lock.
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+)
+
+// VerifyOptions are the options for Verify
+type VerifyOptions struct {
+	// Quarantine moves the corrupted objects out of the storage, into the
+	// .quarantine directory, so they are not linked anymore
+	Quarantine bool
+}
+
+// VerifyMismatch describes an object whose content does not match its name
+type VerifyMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// VerifyReport collects the problems found by Verify
+type VerifyReport struct {
+	// Checked is the number of objects rehashed
+	Checked int `json:"checked"`
+
+	// Mismatches holds the objects whose hash does not match their name
+	Mismatches []VerifyMismatch `json:"mismatches"`
+
+	// MissingMetadata holds the objects without the metadata suffix in a
+	// storage created with metadata
+	MissingMetadata []string `json:"missing_metadata"`
+
+	// ZeroLinks holds the objects not linked anywhere outside the storage
+	ZeroLinks []string `json:"zero_links"`
+
+	// Stray holds the files that are not objects or are not where the
+	// layout expects them
+	Stray []string `json:"stray"`
+
+	// Quarantined holds the objects moved to quarantine
+	Quarantined []string `json:"quarantined"`
+
+	// Errors holds the objects that could not be checked
+	Errors map[string]string `json:"errors"`
+}
+
+// OK reports whether no problem was found
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0 && len(r.MissingMetadata) == 0 &&
+		len(r.ZeroLinks) == 0 && len(r.Stray) == 0 && len(r.Errors) == 0
+}
+
+// Verify rehashes every object in the storage with the given generator and
+// reports the objects that do not match their name, together with other
+// inconsistencies found along the way
+func (s *Storage) Verify(gen hash.Generator, opts VerifyOptions) (*VerifyReport, error) {
+	lockFile, err := s.AcquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReleaseLock(lockFile)
+
+	report := &VerifyReport{Errors: make(map[string]string)}
+	var corrupted []string
+
+	err = s.walkObjects(func(path string, d fs.DirEntry) error {
+		name := d.Name()
+		if !d.Type().IsRegular() || !isObjectName(name) || !s.isObjectLocation(path, name) {
+			report.Stray = append(report.Stray, path)
+			return nil
+		}
+
+		expected := ObjectHash(name)
+		withMetadata := strings.Contains(expected, "-")
+		if s.Opts.WithMetadata && !withMetadata {
+			report.MissingMetadata = append(report.MissingMetadata, path)
+		}
+
+		var actual string
+		var err error
+		if withMetadata {
+			actual, err = gen.ComputeFullHash(path)
+		} else {
+			actual, err = gen.ComputeFileHash(path)
+		}
+		if err != nil {
+			report.Errors[path] = err.Error()
+			return nil
+		}
+
+		report.Checked++
+		if actual != expected {
+			report.Mismatches = append(report.Mismatches, VerifyMismatch{
+				Path:     path,
+				Expected: expected,
+				Actual:   actual,
+			})
+			corrupted = append(corrupted, path)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			report.Errors[path] = err.Error()
+			return nil
+		}
+		if !s.usesHardlinksOnly() {
+			// Reflinks and symlinks do not add to the link count, look
+			// them up instead
+			links, err := s.FindLinks(path, nil)
+			if err == nil && len(links) == 0 {
+				report.ZeroLinks = append(report.ZeroLinks, path)
+			}
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink <= 1 {
+			report.ZeroLinks = append(report.ZeroLinks, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Quarantine && len(corrupted) > 0 {
+		quarantinePath := filepath.Join(s.Opts.Root, ".quarantine")
+		err = os.MkdirAll(quarantinePath, 0755)
+		if err != nil {
+			return report, err
+		}
+
+		err = s.index.markDirty()
+		if err != nil {
+			return report, err
+		}
+
+		for _, path := range corrupted {
+			err = os.Rename(path, filepath.Join(quarantinePath, filepath.Base(path)))
+			if err != nil {
+				return report, err
+			}
+			s.index.remove(filepath.Base(path))
+			report.Quarantined = append(report.Quarantined, path)
+		}
+
+		err = s.index.Save()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// isObjectLocation checks if the object with the given name is where the
+// current layout, or the previous one during a migration, expects it
+func (s *Storage) isObjectLocation(path, name string) bool {
+	if path == s.ObjectPath(name) {
+		return true
+	}
+
+	return s.Opts.PreviousLayout != nil && path == s.Opts.PreviousLayout.objectPath(s.Opts.Root, name)
+}
+
+// CollisionName returns the name given to the n-th object whose hash
+// collides with the one of a different object already in the storage
+func CollisionName(hash string, n int) string {
+	return fmt.Sprintf("%s.%d", hash, n)
+}
+
+// ObjectHash returns the hash of the object with the given name, that is the
+// name without the collision suffix, if any
+func ObjectHash(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// isObjectName checks if the given name looks like an object name, that is
+// a hex hash optionally followed by a hex metadata hash and a collision
+// suffix
+func isObjectName(name string) bool {
+	parts := strings.Split(ObjectHash(name), "-")
+	if len(parts) > 2 {
+		return false
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
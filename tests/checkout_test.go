@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckout(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "checkout")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Store a file
+	filePath := filepath.Join(testPath, "file-0")
+	err = os.WriteFile(filePath, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	fileHash, err := hash.NewSHA256Generator().ComputeFileHash(filePath)
+	assert.Nil(t, err)
+	err = s.MoveFileToStorage(filePath, fileHash)
+	assert.Nil(t, err)
+	objectPath, _, err := s.FindObject(fileHash)
+	assert.Nil(t, err)
+	objectInfo, err := os.Stat(objectPath)
+	assert.Nil(t, err)
+
+	// Check out the object as a link
+	err = s.Checkout(fileHash, filepath.Join(destPath, "link"), false)
+	assert.Nil(t, err)
+	info, err := os.Stat(filepath.Join(destPath, "link"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(objectInfo, info))
+
+	// Check out the object as a copy
+	err = s.Checkout(fileHash, filepath.Join(destPath, "copy"), true)
+	assert.Nil(t, err)
+	info, err = os.Stat(filepath.Join(destPath, "copy"))
+	assert.Nil(t, err)
+	assert.False(t, os.SameFile(objectInfo, info))
+	content, err := os.ReadFile(filepath.Join(destPath, "copy"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+
+	// A missing object fails clearly
+	err = s.Checkout("missing", filepath.Join(destPath, "missing"), false)
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+
+	// Check out a manifest, absolute paths being recreated under the root
+	metadata := storage.FileMetadata{Mode: 0600, Uid: os.Getuid(), Gid: os.Getgid(), ModTime: 1000000000}
+	manifest := storage.Manifest{
+		"/etc/file-0":      {Hash: fileHash, Metadata: &metadata},
+		"usr/share/file-0": {Hash: fileHash},
+	}
+	report, err := s.CheckoutManifest(manifest, filepath.Join(destPath, "root"), true)
+	assert.Nil(t, err)
+	assert.Len(t, report.CheckedOut, 2)
+
+	info, err = os.Stat(filepath.Join(destPath, "root", "etc", "file-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, int64(1000000000), info.ModTime().Unix())
+	_, err = os.Stat(filepath.Join(destPath, "root", "usr", "share", "file-0"))
+	assert.Nil(t, err)
+
+	// Linking again skips the paths already linked
+	report, err = s.CheckoutManifest(manifest, filepath.Join(destPath, "links"), false)
+	assert.Nil(t, err)
+	assert.Len(t, report.CheckedOut, 2)
+	report, err = s.CheckoutManifest(manifest, filepath.Join(destPath, "links"), false)
+	assert.Nil(t, err)
+	assert.Len(t, report.Skipped, 2)
+	info, err = os.Stat(filepath.Join(destPath, "links", "etc", "file-0"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(objectInfo, info))
+
+	// Nothing is created if an object is missing
+	manifest["/etc/other"] = storage.ManifestEntry{Hash: "missing"}
+	_, err = s.CheckoutManifest(manifest, filepath.Join(destPath, "partial"), false)
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+	_, err = os.Stat(filepath.Join(destPath, "partial"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Paths escaping the root are refused
+	_, err = s.CheckoutManifest(storage.Manifest{"../file-0": {Hash: fileHash}}, filepath.Join(destPath, "escape"), false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCpConflicts(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		policy   processor.ConflictPolicy
+		destTime time.Time
+		content  string
+		backup   bool
+		failed   bool
+	}{
+		{policy: processor.ConflictOverwrite, destTime: old, content: "new"},
+		{policy: processor.ConflictNoClobber, destTime: old, content: "old"},
+		{policy: processor.ConflictUpdateIfNewer, destTime: old, content: "new"},
+		{policy: processor.ConflictUpdateIfNewer, destTime: future, content: "old"},
+		{policy: processor.ConflictBackup, destTime: old, content: "new", backup: true},
+		{policy: processor.ConflictFail, destTime: old, content: "old", failed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			testPath := filepath.Join(t.TempDir(), "testdata")
+			storagePath := filepath.Join(t.TempDir(), "storage")
+
+			err := os.MkdirAll(testPath, 0755)
+			assert.Nil(t, err)
+
+			// Create the source and an older or newer destination
+			source := filepath.Join(testPath, "file-0")
+			dest := filepath.Join(testPath, "file-0-copy")
+			err = os.WriteFile(source, []byte("new"), 0644)
+			assert.Nil(t, err)
+			err = os.WriteFile(dest, []byte("old"), 0644)
+			assert.Nil(t, err)
+			err = os.Chtimes(dest, test.destTime, test.destTime)
+			assert.Nil(t, err)
+
+			s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+			assert.Nil(t, err)
+
+			cpProcessor := processor.NewCpProcessor(source, dest, s, hash.NewSHA256Generator())
+			cpProcessor.OnConflict = test.policy
+			cpProcessor.BackupSuffix = ".bak"
+			err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+			if test.failed {
+				assert.True(t, errors.Is(err, processor.ErrDestinationExists))
+			} else {
+				assert.Nil(t, err)
+			}
+
+			content, err := os.ReadFile(dest)
+			assert.Nil(t, err)
+			assert.Equal(t, test.content, string(content))
+
+			if test.content == "new" {
+				assert.Equal(t, []string{dest}, cpProcessor.Stats.ConflictsReplaced)
+			} else if !test.failed {
+				assert.Equal(t, []string{dest}, cpProcessor.Stats.ConflictsSkipped)
+			}
+
+			backup, err := os.ReadFile(dest + ".bak")
+			if test.backup {
+				assert.Nil(t, err)
+				assert.Equal(t, "old", string(backup))
+			} else {
+				assert.True(t, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestDedupDestConflicts(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "dest")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(filepath.Join(testPath, "sub"), 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(destPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data, one destination already existing
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "sub", "file-1"), []byte("other"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(destPath, "file-0"), []byte("existing"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// Existing destinations are left as they are by default, the other ones
+	// are linked in their subdirectory
+	dedupProcessor := processor.NewDedupProcessor(testPath, destPath, s, hash.NewSHA256Generator(), 1)
+	err = dabadee.NewDaBaDee(dedupProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(destPath, "file-0")}, dedupProcessor.Stats.ConflictsSkipped)
+
+	content, err := os.ReadFile(filepath.Join(destPath, "file-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "existing", string(content))
+	content, err = os.ReadFile(filepath.Join(destPath, "sub", "file-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "other", string(content))
+
+	// Overwriting replaces the existing one only, the linked ones are not
+	// conflicts
+	dedupProcessor = processor.NewDedupProcessor(testPath, destPath, s, hash.NewSHA256Generator(), 1)
+	dedupProcessor.Cache = nil
+	dedupProcessor.OnConflict = processor.ConflictOverwrite
+	err = dabadee.NewDaBaDee(dedupProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(destPath, "file-0")}, dedupProcessor.Stats.ConflictsReplaced)
+	assert.Empty(t, dedupProcessor.Stats.ConflictsSkipped)
+
+	content, err = os.ReadFile(filepath.Join(destPath, "file-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+}
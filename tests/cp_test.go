@@ -1,10 +1,13 @@
 package tests
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/mirkobrombin/dabadee/pkg/dabadee"
 	"github.com/mirkobrombin/dabadee/pkg/hash"
@@ -52,7 +55,7 @@ func TestCpCommand(t *testing.T) {
 	d := dabadee.NewDaBaDee(cpProcessor, true)
 
 	// Run the command
-	err = d.Run()
+	err = d.Run(context.Background())
 	if err != nil {
 		t.Fatalf("Error running command: %v", err)
 	}
@@ -68,3 +71,110 @@ func TestCpCommand(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, fileInfo1.Sys().(*syscall.Stat_t).Ino, fileInfo2.Sys().(*syscall.Stat_t).Ino)
 }
+
+func TestCpDirectory(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "copy")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(filepath.Join(testPath, "sub", "deep"), 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Join(testPath, "empty"), 0755)
+	assert.Nil(t, err)
+
+	// Create test data, with a symlink and directories with their own mode
+	// and modification time
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "sub", "deep", "file-1"), []byte("other"), 0600)
+	assert.Nil(t, err)
+	err = os.Symlink("../file-0", filepath.Join(testPath, "sub", "link"))
+	assert.Nil(t, err)
+	err = os.Chmod(filepath.Join(testPath, "sub"), 0750)
+	assert.Nil(t, err)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = os.Chtimes(filepath.Join(testPath, "sub", "deep"), mtime, mtime)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// Copy the tree
+	cpProcessor := processor.NewCpProcessor(testPath, destPath, s, hash.NewSHA256Generator())
+	cpProcessor.Workers = 2
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cpProcessor.Stats.Processed)
+	assert.Equal(t, int64(0), cpProcessor.Stats.BytesReclaimed)
+
+	// Check the files are linked to the storage
+	for _, name := range []string{"file-0", filepath.Join("sub", "deep", "file-1")} {
+		sourceInfo, err := os.Stat(filepath.Join(testPath, name))
+		assert.Nil(t, err)
+		destInfo, err := os.Stat(filepath.Join(destPath, name))
+		assert.Nil(t, err)
+		assert.Equal(t, sourceInfo.Sys().(*syscall.Stat_t).Ino, destInfo.Sys().(*syscall.Stat_t).Ino)
+	}
+	info, err := os.Stat(filepath.Join(destPath, "sub", "deep", "file-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Check the symlink, the empty directory and the directory attributes
+	target, err := os.Readlink(filepath.Join(destPath, "sub", "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "../file-0", target)
+	sourceInfo, err := os.Lstat(filepath.Join(testPath, "sub", "link"))
+	assert.Nil(t, err)
+	info, err = os.Lstat(filepath.Join(destPath, "sub", "link"))
+	assert.Nil(t, err)
+	assert.True(t, info.ModTime().Equal(sourceInfo.ModTime()))
+
+	info, err = os.Stat(filepath.Join(destPath, "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	info, err = os.Stat(filepath.Join(destPath, "sub"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(destPath, "sub", "deep"))
+	assert.Nil(t, err)
+	assert.True(t, info.ModTime().Equal(mtime))
+
+	// A second copy reuses the objects, reclaiming their size
+	cpProcessor = processor.NewCpProcessor(testPath, filepath.Join(t.TempDir(), "copy"), s, hash.NewSHA256Generator())
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cpProcessor.Stats.ReusedObjects)
+	assert.Equal(t, int64(len("test")+len("other")), cpProcessor.Stats.BytesReclaimed)
+}
+
+func TestCpDeadline(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// A past deadline stops the copy like a cancellation, without failing
+	// the file
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	for _, source := range []string{filepath.Join(testPath, "file-0"), testPath} {
+		dest := filepath.Join(t.TempDir(), "copy")
+		cpProcessor := processor.NewCpProcessor(source, dest, s, hash.NewSHA256Generator())
+		err = cpProcessor.Process(ctx, false)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Empty(t, cpProcessor.Stats.Failures)
+		_, err = os.Lstat(filepath.Join(dest, "file-0"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/daemon"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemon(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+	socket := filepath.Join(t.TempDir(), "run", "dabadee.sock")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	file1Path := filepath.Join(testPath, "file1")
+	err = os.WriteFile(file1Path, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	file2Path := filepath.Join(testPath, "file2")
+	err = os.WriteFile(file2Path, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	// Start the daemon
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := daemon.NewServer(socket, hash.NewSHA256Generator())
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx)
+	}()
+
+	for start := time.Now(); !daemon.Running(socket); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Daemon not listening")
+		}
+	}
+
+	// The missing socket directory is created private
+	info, err := os.Stat(filepath.Dir(socket))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Deduplicate through the daemon
+	client := daemon.NewClient(socket)
+	storageParams := daemon.StorageParams{Root: storagePath}
+	var result daemon.RunResult
+	err = client.Call(context.Background(), daemon.MethodDedup, daemon.DedupParams{
+		Storage:  storageParams,
+		Source:   testPath,
+		Manifest: true,
+	}, &result)
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+	assert.Equal(t, 2, result.Stats.Processed)
+	assert.Equal(t, 1, result.Stats.NewObjects)
+	assert.Len(t, result.Manifest, 2)
+
+	info1, err := os.Stat(file1Path)
+	assert.Nil(t, err)
+	info2, err := os.Stat(file2Path)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(info1, info2))
+
+	// The storage stays open with its cache
+	var stats daemon.StatsResult
+	err = client.Call(context.Background(), daemon.MethodStats, nil, &stats)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Requests)
+	if assert.Len(t, stats.Storages, 1) {
+		assert.Equal(t, storagePath, stats.Storages[0].Root)
+		assert.Equal(t, 1, stats.Storages[0].Objects)
+		assert.Equal(t, 2, stats.Storages[0].CacheEntries)
+		assert.Equal(t, 2, stats.Storages[0].LastRun.Processed)
+	}
+
+	// Running again only hits the cache
+	err = client.Call(context.Background(), daemon.MethodDedup, daemon.DedupParams{
+		Storage: storageParams,
+		Source:  testPath,
+	}, &result)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.Stats.Skipped)
+
+	var links []string
+	err = client.Call(context.Background(), daemon.MethodFindLinks, daemon.FindLinksParams{
+		Storage: storageParams,
+		Path:    file1Path,
+	}, &links)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{file1Path, file2Path}, links)
+
+	var report storage.VerifyReport
+	err = client.Call(context.Background(), daemon.MethodVerify, daemon.VerifyParams{Storage: storageParams}, &report)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.Checked)
+
+	// Changes made bypassing the daemon are picked up, and not undone
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	layout := storage.Layout{Depth: 1, Width: 2}
+	_, err = s.MigrateLayout(layout)
+	assert.Nil(t, err)
+
+	file3Path := filepath.Join(testPath, "file3")
+	err = os.WriteFile(file3Path, []byte("other"), 0644)
+	assert.Nil(t, err)
+
+	err = client.Call(context.Background(), daemon.MethodDedup, daemon.DedupParams{
+		Storage: storageParams,
+		Source:  testPath,
+	}, &result)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.Stats.Skipped)
+	assert.Equal(t, 1, result.Stats.NewObjects)
+
+	s, err = storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	assert.Equal(t, layout, s.Opts.Layout)
+	assert.Nil(t, s.Opts.PreviousLayout)
+	assert.Equal(t, 2, s.Index().Len())
+	for _, path := range []string{file1Path, file3Path} {
+		fileHash, err := hash.NewSHA256Generator().ComputeFileHash(path)
+		assert.Nil(t, err)
+		_, err = os.Stat(s.ObjectPath(fileHash))
+		assert.Nil(t, err)
+	}
+
+	// Errors are sent back to the client
+	err = client.Call(context.Background(), daemon.MethodRm, daemon.RmParams{
+		Storage: daemon.StorageParams{Root: "relative"},
+		Path:    file1Path,
+	}, nil)
+	assert.ErrorContains(t, err, "must be absolute")
+
+	err = client.Call(context.Background(), daemon.MethodRm, daemon.RmParams{
+		Storage: daemon.StorageParams{Root: t.TempDir()},
+		Path:    file1Path,
+	}, nil)
+	assert.ErrorContains(t, err, "not a storage")
+
+	err = client.Call(context.Background(), "unknown", nil, nil)
+	assert.ErrorContains(t, err, "unknown method")
+
+	// Stopping the daemon removes the socket
+	cancel()
+	assert.Nil(t, <-done)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDaemonSocketOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of the socket requires root")
+	}
+
+	// A socket created by another user is not trusted
+	socket := filepath.Join(t.TempDir(), "dabadee.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	err = os.Lchown(socket, 65534, 65534)
+	assert.Nil(t, err)
+
+	assert.False(t, daemon.Running(socket))
+	err = daemon.NewClient(socket).Call(context.Background(), daemon.MethodStats, nil, nil)
+	assert.ErrorContains(t, err, "owned by uid 65534")
+}
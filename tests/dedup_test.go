@@ -1,9 +1,12 @@
 package tests
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/mirkobrombin/dabadee/pkg/dabadee"
@@ -56,7 +59,7 @@ func TestDedupCommand(t *testing.T) {
 	d := dabadee.NewDaBaDee(processor, true)
 
 	// Run the deduplication
-	err = d.Run()
+	err = d.Run(context.Background())
 	if err != nil {
 		t.Fatalf("Error during deduplication: %v", err)
 	}
@@ -68,3 +71,340 @@ func TestDedupCommand(t *testing.T) {
 
 	t.Logf("There are %d files in the storage (%d different files + 50 duplicated files treated as one)", len(files), diffTestFiles)
 }
+
+func TestDedupParanoid(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	filePath := filepath.Join(testPath, "file")
+	err = os.WriteFile(filePath, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Plant an object with the same hash and a different content, as a
+	// collision would do
+	h := hash.NewSHA256Generator()
+	fileHash, err := h.ComputeFileHash(filePath)
+	assert.Nil(t, err)
+	err = os.WriteFile(s.ObjectPath(fileHash), []byte("collision"), 0644)
+	assert.Nil(t, err)
+
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	p.Paranoid = true
+
+	err = dabadee.NewDaBaDee(p, true).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// The file kept its content and was stored under a disambiguated name
+	content, err := os.ReadFile(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+	assert.Equal(t, []string{filePath}, p.Stats.Collisions)
+	assert.Equal(t, storage.CollisionName(fileHash, 1), p.FileMap[filePath])
+
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestDedupDryRun(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	err = os.WriteFile(filepath.Join(testPath, "unique"), []byte("unique"), 0644)
+	assert.Nil(t, err)
+
+	const sameTestFiles = 3
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 2)
+	p.DryRun = true
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// Only the first copy of each content would be moved
+	assert.Equal(t, 2, p.DryRunReport.NewObjects)
+	assert.Equal(t, 2, len(p.DryRunReport.Moved))
+	assert.Equal(t, sameTestFiles-1, len(p.DryRunReport.Linked))
+	assert.Equal(t, int64(4*(sameTestFiles-1)), p.DryRunReport.ReclaimableBytes)
+
+	// Nothing has been touched
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	for i := 0; i < sameTestFiles; i++ {
+		info, err := os.Lstat(filepath.Join(testPath, fmt.Sprintf("same-file-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), info.Sys().(*syscall.Stat_t).Nlink)
+	}
+
+	// Once deduplicated, nothing is left to reclaim
+	p = processor.NewDedupProcessor(testPath, "", s, h, 2)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	p = processor.NewDedupProcessor(testPath, "", s, h, 2)
+	p.Cache = nil
+	p.DryRun = true
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, p.DryRunReport.Moved)
+	assert.Empty(t, p.DryRunReport.Linked)
+	assert.Equal(t, sameTestFiles+1, len(p.DryRunReport.AlreadyLinked))
+	assert.Equal(t, int64(0), p.DryRunReport.ReclaimableBytes)
+}
+
+func TestDedupCancel(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const testFiles = 20
+	for i := 0; i < testFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("file-%02d", i))
+		err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%d", i)), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Cancel the run while walking, as an interrupt would
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seen := 0
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	p.Filters = append(p.Filters, func(path string, info os.FileInfo) bool {
+		seen++
+		if seen == 5 {
+			cancel()
+		}
+		return true
+	})
+	err = dabadee.NewDaBaDee(p, false).Run(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, p.Stats.Processed, testFiles)
+
+	// The lock has been released and the completed files recorded
+	lockFile, err := s.AcquireLock()
+	assert.Nil(t, err)
+	s.ReleaseLock(lockFile)
+
+	// Running again resumes the work
+	p = processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, p.Stats.Processed+p.Stats.Skipped)
+	assert.Greater(t, p.Stats.Skipped, 0)
+
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, len(files))
+}
+
+func TestDedupFailures(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		// Create temporary directories
+		testPath := filepath.Join(t.TempDir(), "testdata")
+		storagePath := filepath.Join(t.TempDir(), "storage")
+
+		err := os.MkdirAll(testPath, 0755)
+		assert.Nil(t, err)
+
+		// Create test data, the first file vanishes once found
+		const testFiles = 10
+		for i := 0; i < testFiles; i++ {
+			filePath := filepath.Join(testPath, fmt.Sprintf("file-%d", i))
+			err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%d", i)), 0644)
+			assert.Nil(t, err)
+		}
+
+		vanishing := filepath.Join(testPath, "file-0")
+		vanish := func(path string, info os.FileInfo) bool {
+			if path == vanishing {
+				os.Remove(path)
+			}
+			return true
+		}
+
+		s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+		if err != nil {
+			t.Fatalf("Error creating storage: %v", err)
+		}
+
+		h := hash.NewSHA256Generator()
+		p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+		p.Filters = append(p.Filters, vanish)
+		p.FailFast = failFast
+		err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+
+		var partial *processor.PartialError
+		assert.ErrorAs(t, err, &partial)
+		assert.Equal(t, 1, len(partial.Errors))
+		assert.Equal(t, vanishing, partial.Errors[0].Path)
+		assert.Equal(t, processor.StageOpen, partial.Errors[0].Stage)
+
+		// The other files are processed anyway, unless in fail-fast mode
+		if failFast {
+			assert.Equal(t, 0, p.Stats.Processed)
+		} else {
+			assert.Equal(t, testFiles-1, p.Stats.Processed)
+		}
+	}
+}
+
+func TestDedupStats(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const diffTestFiles = 20
+	for i := 0; i < diffTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("file-%02d", i))
+		err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%02d", i)), 0644)
+		assert.Nil(t, err)
+	}
+
+	const sameTestFiles = 10
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 4)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	const testFiles = diffTestFiles + sameTestFiles
+	assert.Equal(t, testFiles, p.Stats.Processed)
+	assert.Equal(t, diffTestFiles+1, p.Stats.NewObjects)
+	assert.Equal(t, sameTestFiles-1, p.Stats.ReusedObjects)
+	assert.Equal(t, int64(7*diffTestFiles+4*sameTestFiles), p.Stats.BytesScanned)
+	assert.Equal(t, int64(4*(sameTestFiles-1)), p.Stats.BytesReclaimed)
+	assert.Empty(t, p.Stats.ErrorsByStage)
+
+	// Every file has been handled by one of the workers
+	assert.Equal(t, 4, len(p.Stats.Workers))
+	files := 0
+	for _, worker := range p.Stats.Workers {
+		files += worker.Files
+	}
+	assert.Equal(t, testFiles, files)
+
+	// Running again only hits the cache
+	p = processor.NewDedupProcessor(testPath, "", s, h, 4)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, p.Stats.Processed)
+	assert.Equal(t, testFiles, p.Stats.CacheHits)
+	assert.Equal(t, testFiles, p.Stats.Skipped)
+	assert.Equal(t, int64(0), p.Stats.BytesScanned)
+
+	data, err := json.Marshal(&p.Stats)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"cache_hits":30`)
+
+	// Without the cache, files linked already are left as they are and
+	// reclaim nothing
+	p = processor.NewDedupProcessor(testPath, "", s, h, 4)
+	p.Cache = nil
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, p.Stats.Processed)
+	assert.Equal(t, testFiles, p.Stats.AlreadyLinked)
+	assert.Equal(t, 0, p.Stats.ReusedObjects)
+	assert.Equal(t, int64(0), p.Stats.BytesReclaimed)
+}
+
+func TestDedupSymlinks(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	outsidePath := filepath.Join(t.TempDir(), "outside")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(outsidePath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data, with symlinks to files outside and inside the source
+	err = os.WriteFile(filepath.Join(outsidePath, "target"), []byte("outside"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.Symlink(filepath.Join(outsidePath, "target"), filepath.Join(testPath, "outside-link"))
+	assert.Nil(t, err)
+	err = os.Symlink("file-0", filepath.Join(testPath, "inside-link"))
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	p := processor.NewDedupProcessor(testPath, "", s, hash.NewSHA256Generator(), 2)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, p.Stats.Processed)
+	assert.Empty(t, p.Stats.Failures)
+
+	// The symlinks and their targets are left alone
+	for name, target := range map[string]string{
+		"outside-link": filepath.Join(outsidePath, "target"),
+		"inside-link":  "file-0",
+	} {
+		link, err := os.Readlink(filepath.Join(testPath, name))
+		assert.Nil(t, err)
+		assert.Equal(t, target, link)
+	}
+	content, err := os.ReadFile(filepath.Join(outsidePath, "target"))
+	assert.Nil(t, err)
+	assert.Equal(t, "outside", string(content))
+	assert.Equal(t, 1, s.Index().Len())
+}
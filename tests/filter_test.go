@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilters(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		name    string
+		size    int
+		mode    os.FileMode
+		modTime time.Time
+	}{
+		{"tiny", 1, 0644, old},
+		{"small", 10, 0644, old},
+		{"large", 1000, 0644, old},
+		{"recent", 10, 0644, time.Now()},
+		{"script", 10, 0755, old},
+		{"setuid", 10, 0644 | os.ModeSetuid, old},
+	}
+	for _, f := range files {
+		path := filepath.Join(testPath, f.name)
+		err = os.WriteFile(path, []byte(strings.Repeat(f.name[:1], f.size)), 0644)
+		assert.Nil(t, err)
+		err = os.Chmod(path, f.mode)
+		assert.Nil(t, err)
+		err = os.Chtimes(path, f.modTime, f.modTime)
+		assert.Nil(t, err)
+	}
+	err = os.Symlink(filepath.Join(testPath, "small"), filepath.Join(testPath, "link"))
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Combine the built-in filters with a custom one
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	p.Filters = []processor.Filter{
+		processor.MinSize(2),
+		processor.MaxSize(100),
+		processor.OlderThan(24 * time.Hour),
+		processor.RegularOnly,
+		processor.NoSetuid,
+		processor.NoExecutable,
+		func(path string, info os.FileInfo) bool {
+			return info.Name() != "large"
+		},
+	}
+	p.DryRun = true
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	assert.Equal(t, []string{filepath.Join(testPath, "small")}, p.DryRunReport.Moved)
+	assert.Equal(t, len(files), p.Stats.Filtered)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data, opening the FIFO would block the walk
+	err = os.WriteFile(filepath.Join(testPath, "file"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = syscall.Mkfifo(filepath.Join(testPath, "fifo"), 0644)
+	assert.Nil(t, err)
+	err = os.Symlink("fifo", filepath.Join(testPath, "fifo-link"))
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	p.OneFileSystem = true
+
+	done := make(chan error)
+	go func() {
+		done <- dabadee.NewDaBaDee(p, false).Run(context.Background())
+	}()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Deduplication blocked on a special file")
+	}
+
+	assert.Equal(t, 2, p.Stats.Special)
+	assert.Empty(t, p.Stats.Mounts)
+	assert.Equal(t, 1, len(p.FileMap))
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindDupes(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	otherPath := filepath.Join(t.TempDir(), "other")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(otherPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data: duplicates across both paths, a hardlink counting
+	// as the same file, a file of the same size with another content, an
+	// empty file and an excluded one
+	write := func(path, content string) string {
+		err := os.WriteFile(path, []byte(content), 0644)
+		assert.Nil(t, err)
+		return path
+	}
+	file1Path := write(filepath.Join(testPath, "file1"), "dup")
+	file2Path := write(filepath.Join(testPath, "file2"), "dup")
+	file3Path := write(filepath.Join(otherPath, "file3"), "dup")
+	write(filepath.Join(testPath, "same-size"), "dip")
+	write(filepath.Join(testPath, "empty1"), "")
+	write(filepath.Join(testPath, "empty2"), "")
+	write(filepath.Join(testPath, "excluded"), "dup")
+
+	linkPath := filepath.Join(testPath, "link")
+	err = os.Link(file1Path, linkPath)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(file2Path)
+	assert.Nil(t, err)
+
+	p := processor.NewFindDupesProcessor([]string{testPath, otherPath}, hash.NewSHA256Generator(), 2)
+	p.Exclude = []string{"excluded"}
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error finding duplicates: %v", err)
+	}
+
+	if assert.Len(t, p.Groups, 1) {
+		group := p.Groups[0]
+		assert.Equal(t, int64(3), group.Size)
+		assert.ElementsMatch(t, []string{file1Path, file2Path, file3Path, linkPath}, group.Paths)
+		assert.True(t, sort.StringsAreSorted(group.Paths))
+		assert.Equal(t, int64(6), group.Wasted)
+	}
+	assert.Equal(t, int64(6), p.Wasted())
+	assert.Contains(t, p.Stats.Ignored, filepath.Join(testPath, "excluded"))
+
+	// Nothing is touched
+	after, err := os.Stat(file2Path)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(info, after))
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	// Create test data, the ignore file of sub excludes the text files
+	// there except keep.txt
+	files := map[string]string{
+		"a.log":              "log",
+		"a.txt":              "text",
+		"cache/a.txt":        "cache",
+		"sub/b.txt":          "text",
+		"sub/keep.txt":       "keep",
+		"sub/deep/c.txt":     "text",
+		"sub/deep/d.data":    "data",
+		"sub/.dabadeeignore": "# text files\n*.txt\n!keep.txt\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(testPath, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(path, []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	p.Exclude = []string{"*.log", "cache/"}
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	var processed []string
+	for path := range p.FileMap {
+		rel, err := filepath.Rel(testPath, path)
+		assert.Nil(t, err)
+		processed = append(processed, rel)
+	}
+	sort.Strings(processed)
+	assert.Equal(t, []string{"a.txt", "sub/.dabadeeignore", "sub/deep/d.data", "sub/keep.txt"}, processed)
+
+	// Each skipped path is recorded along with the rule excluding it
+	ignoreFile := filepath.Join(testPath, "sub", ".dabadeeignore")
+	assert.Equal(t, map[string]string{
+		filepath.Join(testPath, "a.log"):                "--exclude:0:*.log",
+		filepath.Join(testPath, "cache"):                "--exclude:0:cache/",
+		filepath.Join(testPath, "sub", "b.txt"):         ignoreFile + ":2:*.txt",
+		filepath.Join(testPath, "sub", "deep", "c.txt"): ignoreFile + ":2:*.txt",
+	}, p.Stats.Ignored)
+	assert.Equal(t, []string{
+		"--exclude:0:*.log",
+		"--exclude:0:cache/",
+		ignoreFile + ":2:*.txt",
+		ignoreFile + ":3:!keep.txt",
+	}, p.Stats.Rules)
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const sameTestFiles = 5
+	var sameFiles []string
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+		sameFiles = append(sameFiles, filePath)
+	}
+
+	err = os.WriteFile(filepath.Join(testPath, "other-file"), []byte("other"), 0644)
+	assert.Nil(t, err)
+
+	// Deduplicate
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 2)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// The index must know both objects and their references
+	sameHash := p.FileMap[sameFiles[0]]
+	entry, ok := s.Index().Get(sameHash)
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), entry.Size)
+	sort.Strings(entry.Paths)
+	assert.Equal(t, sameFiles, entry.Paths)
+	assert.Equal(t, 2, len(s.Index().Entries))
+
+	links, err := s.FindLinks(sameFiles[0], nil)
+	assert.Nil(t, err)
+	sort.Strings(links)
+	assert.Equal(t, sameFiles, links)
+
+	// Rebuild the index from scratch after losing it
+	err = os.Remove(filepath.Join(storagePath, ".index"))
+	assert.Nil(t, err)
+
+	s, err = storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	assert.False(t, s.Index().Complete)
+
+	err = s.RebuildIndex()
+	assert.Nil(t, err)
+	assert.True(t, s.Index().Complete)
+
+	rebuilt, ok := s.Index().Get(sameHash)
+	assert.True(t, ok)
+	sort.Strings(rebuilt.Paths)
+	assert.Equal(t, sameFiles, rebuilt.Paths)
+	assert.Equal(t, entry.Inode, rebuilt.Inode)
+
+	// Removing a file drops it from the index
+	err = s.RemoveFile(sameFiles[0])
+	assert.Nil(t, err)
+	_, ok = s.Index().Get(sameHash)
+	assert.False(t, ok)
+	for _, path := range sameFiles {
+		_, err = os.Lstat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestIndexConcurrentStorages(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	for _, dir := range []string{"a", "b"} {
+		err := os.MkdirAll(filepath.Join(testPath, dir), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(testPath, dir, "file"), []byte(dir), 0644)
+		assert.Nil(t, err)
+	}
+
+	// Open the storage twice, as two processes would, before either runs
+	first, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	second, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	h := hash.NewSHA256Generator()
+	for _, run := range []struct {
+		storage *storage.Storage
+		dir     string
+	}{{first, "a"}, {second, "b"}} {
+		p := processor.NewDedupProcessor(filepath.Join(testPath, run.dir), "", run.storage, h, 1)
+		err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+		assert.Nil(t, err)
+	}
+
+	// The second run must not drop what the first one indexed
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	assert.True(t, s.Index().Complete)
+	assert.Equal(t, 2, s.Index().Len())
+
+	err = s.RemoveOrphans()
+	assert.Nil(t, err)
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestIndexInterruptedRun(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	filePath := filepath.Join(testPath, "file")
+	err = os.WriteFile(filePath, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	err = s.SaveIndex()
+	assert.Nil(t, err)
+	other, err := storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+	assert.True(t, other.Index().Complete)
+
+	// Store a file, stopping before saving the index
+	fileHash, err := hash.NewSHA256Generator().ComputeFileHash(filePath)
+	assert.Nil(t, err)
+	err = s.MoveFileToStorage(filePath, fileHash)
+	assert.Nil(t, err)
+
+	// The index is incomplete for whoever opens or locks the storage next,
+	// and stays so once saved
+	reopened, err := storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+	assert.False(t, reopened.Index().Complete)
+
+	lockFile, err := other.AcquireLock()
+	assert.Nil(t, err)
+	assert.False(t, other.Index().Complete)
+	err = other.SaveIndex()
+	assert.Nil(t, err)
+	other.ReleaseLock(lockFile)
+
+	reopened, err = storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+	assert.False(t, reopened.Index().Complete)
+
+	// Rebuilding makes it complete again
+	err = reopened.RebuildIndex()
+	assert.Nil(t, err)
+	reopened, err = storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+	assert.True(t, reopened.Index().Complete)
+}
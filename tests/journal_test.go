@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Create test data
+	movedPath := filepath.Join(testPath, "moved")
+	err = os.WriteFile(movedPath, []byte("moved"), 0644)
+	assert.Nil(t, err)
+
+	untouchedPath := filepath.Join(testPath, "untouched")
+	err = os.WriteFile(untouchedPath, []byte("untouched"), 0644)
+	assert.Nil(t, err)
+
+	h := hash.NewSHA256Generator()
+	movedHash, err := h.ComputeFileHash(movedPath)
+	assert.Nil(t, err)
+	untouchedHash, err := h.ComputeFileHash(untouchedPath)
+	assert.Nil(t, err)
+
+	// Simulate a crash after renaming a file into the storage and before
+	// linking it back, and another one before renaming at all
+	err = os.Rename(movedPath, s.ObjectPath(movedHash))
+	assert.Nil(t, err)
+
+	journal, err := os.Create(filepath.Join(storagePath, ".journal"))
+	assert.Nil(t, err)
+	enc := json.NewEncoder(journal)
+	assert.Nil(t, enc.Encode(storage.JournalEntry{ID: "1", Op: storage.JournalMove, Hash: movedHash, Path: movedPath}))
+	assert.Nil(t, enc.Encode(storage.JournalEntry{ID: "2", Op: storage.JournalMove, Hash: untouchedHash, Path: untouchedPath}))
+	journal.Close()
+
+	// Opening the storage recovers the journal
+	s, err = storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(s.Recovered))
+	assert.Equal(t, "relinked", s.Recovered[0].Action)
+	assert.Equal(t, "rolled-back", s.Recovered[1].Action)
+
+	movedInfo, err := os.Lstat(movedPath)
+	assert.Nil(t, err)
+	objectInfo, err := os.Lstat(s.ObjectPath(movedHash))
+	assert.Nil(t, err)
+	assert.Equal(t, movedInfo.Sys().(*syscall.Stat_t).Ino, objectInfo.Sys().(*syscall.Stat_t).Ino)
+
+	// Nothing is left to recover
+	actions, err := s.Recover()
+	assert.Nil(t, err)
+	assert.Empty(t, actions)
+
+	// A crash of another process while this one waits for the lock is
+	// recovered once the lock is acquired, not lost by its own operations
+	victimPath := filepath.Join(testPath, "victim")
+	err = os.WriteFile(victimPath, []byte("victim"), 0644)
+	assert.Nil(t, err)
+	victimHash, err := h.ComputeFileHash(victimPath)
+	assert.Nil(t, err)
+	err = os.Rename(victimPath, s.ObjectPath(victimHash))
+	assert.Nil(t, err)
+
+	journal, err = os.OpenFile(filepath.Join(storagePath, ".journal"), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewEncoder(journal).Encode(storage.JournalEntry{ID: "3", Op: storage.JournalMove, Hash: victimHash, Path: victimPath}))
+	journal.Close()
+
+	otherPath := filepath.Join(testPath, "other")
+	err = os.WriteFile(otherPath, []byte("other"), 0644)
+	assert.Nil(t, err)
+	p := processor.NewDedupProcessor(otherPath, "", s, h, 1)
+	err = p.Process(context.Background(), false)
+	assert.Nil(t, err)
+
+	content, err := os.ReadFile(victimPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "victim", string(content))
+	if assert.Len(t, s.Recovered, 3) {
+		assert.Equal(t, "relinked", s.Recovered[2].Action)
+	}
+
+	// A replace interrupted before removing the path leaves it independent,
+	// it is rolled back rather than indexed as a link
+	independentPath := filepath.Join(testPath, "independent")
+	err = os.WriteFile(independentPath, []byte("moved"), 0644)
+	assert.Nil(t, err)
+
+	journal, err = os.OpenFile(filepath.Join(storagePath, ".journal"), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewEncoder(journal).Encode(storage.JournalEntry{ID: "4", Op: storage.JournalReplace, Hash: movedHash, Path: independentPath}))
+	journal.Close()
+
+	actions, err = s.Recover()
+	assert.Nil(t, err)
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, "rolled-back", actions[0].Action)
+	}
+	entry, ok := s.Index().Get(movedHash)
+	assert.True(t, ok)
+	assert.NotContains(t, entry.Paths, independentPath)
+}
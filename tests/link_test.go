@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutoLinkMode(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const sameTestFiles = 5
+	var sameFiles []string
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+		sameFiles = append(sameFiles, filePath)
+	}
+
+	// Deduplicate, reflinking where supported and hardlinking elsewhere
+	s, err := storage.NewStorage(storage.StorageOptions{
+		Root:     storagePath,
+		LinkMode: storage.LinkAuto,
+	})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// Every file is linked to the same object either way
+	for _, path := range sameFiles {
+		info, err := os.Lstat(path)
+		assert.Nil(t, err)
+		assert.True(t, s.IsLinked(path, info, p.FileMap[sameFiles[0]]))
+	}
+
+	links, err := s.FindLinks(s.ObjectPath(p.FileMap[sameFiles[0]]), nil)
+	assert.Nil(t, err)
+	sort.Strings(links)
+	assert.Equal(t, sameFiles, links)
+
+	report, err := s.Verify(h, storage.VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	// An indexed path replaced by different content of the same size is not
+	// taken for a reflink
+	err = os.Remove(sameFiles[1])
+	assert.Nil(t, err)
+	err = os.WriteFile(sameFiles[1], []byte("tset"), 0644)
+	assert.Nil(t, err)
+	info, err := os.Lstat(sameFiles[1])
+	assert.Nil(t, err)
+	assert.False(t, s.IsLinked(sameFiles[1], info, p.FileMap[sameFiles[0]]))
+}
+
+func TestInvalidLinkMode(t *testing.T) {
+	_, err := storage.NewStorage(storage.StorageOptions{
+		Root:     filepath.Join(t.TempDir(), "storage"),
+		LinkMode: "copy",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestSymlinkMode(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const sameTestFiles = 3
+	var sameFiles []string
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+		sameFiles = append(sameFiles, filePath)
+	}
+
+	// Deduplicate using relative symlinks
+	s, err := storage.NewStorage(storage.StorageOptions{
+		Root:             storagePath,
+		LinkMode:         storage.LinkSymlink,
+		RelativeSymlinks: true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// Every file is now a relative symlink to the object
+	objectPath := s.ObjectPath(p.FileMap[sameFiles[0]])
+	for _, path := range sameFiles {
+		target, err := os.Readlink(path)
+		assert.Nil(t, err)
+		assert.False(t, filepath.IsAbs(target))
+
+		content, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, "test", string(content))
+	}
+
+	links, err := s.FindLinks(objectPath, nil)
+	assert.Nil(t, err)
+	sort.Strings(links)
+	assert.Equal(t, sameFiles, links)
+
+	// Removing through one of the symlinks removes all of them
+	err = s.RemoveFile(sameFiles[0])
+	assert.Nil(t, err)
+	for _, path := range append(sameFiles, objectPath) {
+		_, err = os.Lstat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
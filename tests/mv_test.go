@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMv(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "release")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(filepath.Join(testPath, "sub"), 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Join(destPath, "sub"), 0755)
+	assert.Nil(t, err)
+
+	// Create test data, with a file already in the destination
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "sub", "file-1"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "sub", "file-2"), []byte("new"), 0644)
+	assert.Nil(t, err)
+	err = os.Symlink("file-0", filepath.Join(testPath, "link"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(destPath, "sub", "file-2"), []byte("existing"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// Move the tree, leaving the existing file in the destination
+	mvProcessor := processor.NewMvProcessor(testPath, destPath, s, hash.NewSHA256Generator())
+	mvProcessor.OnConflict = processor.ConflictNoClobber
+	err = dabadee.NewDaBaDee(mvProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, mvProcessor.Stats.Processed)
+	assert.Equal(t, 1, mvProcessor.Stats.ReusedObjects)
+
+	// Check the moved files are in the destination, linked to the storage
+	for _, name := range []string{"file-0", filepath.Join("sub", "file-1")} {
+		content, err := os.ReadFile(filepath.Join(destPath, name))
+		assert.Nil(t, err)
+		assert.Equal(t, "test", string(content))
+
+		info, err := os.Lstat(filepath.Join(destPath, name))
+		assert.Nil(t, err)
+		hash, err := hash.NewSHA256Generator().ComputeFileHash(filepath.Join(destPath, name))
+		assert.Nil(t, err)
+		assert.True(t, s.IsLinked(filepath.Join(destPath, name), info, hash))
+
+		_, err = os.Lstat(filepath.Join(testPath, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	target, err := os.Readlink(filepath.Join(destPath, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "file-0", target)
+	_, err = os.Lstat(filepath.Join(testPath, "link"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Check the file not moved is left in the source with its directory
+	content, err := os.ReadFile(filepath.Join(destPath, "sub", "file-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "existing", string(content))
+	content, err = os.ReadFile(filepath.Join(testPath, "sub", "file-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+
+	entries, err := os.ReadDir(testPath)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "sub", entries[0].Name())
+
+	// Moving the rest removes the source
+	mvProcessor.OnConflict = processor.ConflictOverwrite
+	err = dabadee.NewDaBaDee(mvProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	content, err = os.ReadFile(filepath.Join(destPath, "sub", "file-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+	_, err = os.Stat(testPath)
+	assert.True(t, os.IsNotExist(err))
+}
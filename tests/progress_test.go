@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressEvents(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const diffTestFiles = 10
+	for i := 0; i < diffTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("file-%d", i))
+		err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%d", i)), 0644)
+		assert.Nil(t, err)
+	}
+
+	const sameTestFiles = 5
+	for i := 0; i < sameTestFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("same-file-%d", i))
+		err = os.WriteFile(filePath, []byte("test"), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 3)
+
+	// Subscribe both the built-in aggregator and a custom function
+	progress := processor.NewProgress()
+	p.Subscribe(progress.Handle)
+
+	var mu sync.Mutex
+	kinds := make(map[processor.ProgressEventKind]int)
+	p.Subscribe(func(event processor.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		kinds[event.Kind]++
+	})
+
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	const testFiles = diffTestFiles + sameTestFiles
+	snapshot := progress.Snapshot()
+	assert.True(t, snapshot.WalkDone)
+	assert.Equal(t, testFiles, snapshot.FilesDiscovered)
+	assert.Equal(t, testFiles, snapshot.FilesHashed)
+	assert.Equal(t, testFiles, snapshot.FilesDone)
+	assert.Equal(t, snapshot.BytesDiscovered, snapshot.BytesDone)
+	assert.Equal(t, int64(4*(sameTestFiles-1)), snapshot.BytesSaved)
+	assert.Empty(t, snapshot.Current)
+
+	assert.Equal(t, testFiles, kinds[processor.EventStarted])
+	assert.Equal(t, diffTestFiles+1, kinds[processor.EventStored])
+	assert.Equal(t, sameTestFiles-1, kinds[processor.EventLinked])
+	assert.Equal(t, 0, kinds[processor.EventFailed])
+}
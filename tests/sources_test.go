@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupMultipleSources(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "dest")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	// Create two trees sharing a file
+	for _, name := range []string{"rootfs-a", "rootfs-b"} {
+		err := os.MkdirAll(filepath.Join(testPath, name, "etc"), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(testPath, name, "etc", "os-release"), []byte("same"), 0644)
+		assert.Nil(t, err)
+	}
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// Deduplicate both in one run
+	dedupProcessor := processor.NewDedupProcessor(filepath.Join(testPath, "rootfs-a"), destPath, s, hash.NewSHA256Generator(), 2)
+	dedupProcessor.AdditionalSources = []string{filepath.Join(testPath, "rootfs-b")}
+	err = dabadee.NewDaBaDee(dedupProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	// Check the stats and manifest cover both trees
+	assert.Equal(t, 2, dedupProcessor.Stats.Processed)
+	assert.Equal(t, 1, dedupProcessor.Stats.NewObjects)
+	assert.Equal(t, 1, dedupProcessor.Stats.ReusedObjects)
+	assert.Len(t, dedupProcessor.Manifest(), 2)
+
+	// Check each tree is linked into the destination under its name
+	infoA, err := os.Stat(filepath.Join(destPath, "rootfs-a", "etc", "os-release"))
+	assert.Nil(t, err)
+	infoB, err := os.Stat(filepath.Join(destPath, "rootfs-b", "etc", "os-release"))
+	assert.Nil(t, err)
+	assert.Equal(t, infoA.Sys().(*syscall.Stat_t).Ino, infoB.Sys().(*syscall.Stat_t).Ino)
+
+	// Sources sharing a base name are refused instead of being merged
+	for _, name := range []string{"a", "b"} {
+		err = os.MkdirAll(filepath.Join(testPath, name, "data"), 0755)
+		assert.Nil(t, err)
+	}
+	dedupProcessor = processor.NewDedupProcessor(filepath.Join(testPath, "a", "data"), destPath, s, hash.NewSHA256Generator(), 2)
+	dedupProcessor.AdditionalSources = []string{filepath.Join(testPath, "b", "data")}
+	err = dabadee.NewDaBaDee(dedupProcessor, false).Run(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestCpMultipleSources(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	destPath := filepath.Join(t.TempDir(), "dest")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(filepath.Join(testPath, "dir"), 0755)
+	assert.Nil(t, err)
+
+	// Create a file and a directory to copy
+	err = os.WriteFile(filepath.Join(testPath, "file-0"), []byte("test"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "dir", "file-1"), []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+
+	// The destination must be a directory
+	cpProcessor := processor.NewCpProcessor(filepath.Join(testPath, "file-0"), destPath, s, hash.NewSHA256Generator())
+	cpProcessor.AdditionalSources = []string{filepath.Join(testPath, "dir")}
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.NotNil(t, err)
+
+	err = os.MkdirAll(destPath, 0755)
+	assert.Nil(t, err)
+
+	// Copy both into it
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cpProcessor.Stats.Processed)
+
+	content, err := os.ReadFile(filepath.Join(destPath, "file-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+	content, err = os.ReadFile(filepath.Join(destPath, "dir", "file-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+
+	// A single file is copied into an existing directory too
+	err = os.WriteFile(filepath.Join(testPath, "file-2"), []byte("other"), 0644)
+	assert.Nil(t, err)
+	cpProcessor = processor.NewCpProcessor(filepath.Join(testPath, "file-2"), destPath, s, hash.NewSHA256Generator())
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.Nil(t, err)
+
+	content, err = os.ReadFile(filepath.Join(destPath, "file-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "other", string(content))
+
+	// Sources sharing a base name are refused instead of being merged
+	err = os.MkdirAll(filepath.Join(testPath, "other"), 0755)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(testPath, "other", "file-0"), []byte("other"), 0644)
+	assert.Nil(t, err)
+	cpProcessor = processor.NewCpProcessor(filepath.Join(testPath, "file-0"), destPath, s, hash.NewSHA256Generator())
+	cpProcessor.AdditionalSources = []string{filepath.Join(testPath, "other", "file-0")}
+	err = dabadee.NewDaBaDee(cpProcessor, false).Run(context.Background())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const testFiles = 20
+	for i := 0; i < testFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("file-%d", i))
+		err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%d", i)), 0644)
+		assert.Nil(t, err)
+	}
+
+	// Deduplicate using the flat layout
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 2)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// Migrate to a sharded layout
+	layout := storage.Layout{Depth: 2, Width: 2}
+	moved, err := s.MigrateLayout(layout)
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, moved)
+
+	// Reopen the storage, the layout must have been recorded
+	s, err = storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	assert.Nil(t, err)
+	assert.Equal(t, layout, s.Opts.Layout)
+	assert.Nil(t, s.Opts.PreviousLayout)
+
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, len(files))
+
+	// Every deduplicated file must still be linked to its object
+	for path, fileHash := range p.FileMap {
+		objectPath := s.ObjectPath(fileHash)
+		assert.Equal(t, filepath.Join(storagePath, fileHash[:2], fileHash[2:4], fileHash), objectPath)
+
+		fileInfo, err := os.Lstat(path)
+		assert.Nil(t, err)
+		objectInfo, err := os.Lstat(objectPath)
+		assert.Nil(t, err)
+		assert.Equal(t, fileInfo.Sys().(*syscall.Stat_t).Ino, objectInfo.Sys().(*syscall.Stat_t).Ino)
+	}
+
+	// Migrate back to the flat layout
+	moved, err = s.MigrateLayout(storage.Layout{})
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, moved)
+
+	entries, err := os.ReadDir(storagePath)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.False(t, entry.IsDir(), "unexpected directory %s", entry.Name())
+	}
+}
+
+func TestMigrateLayoutSymlinks(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	const testFiles = 5
+	for i := 0; i < testFiles; i++ {
+		filePath := filepath.Join(testPath, fmt.Sprintf("file-%d", i))
+		err = os.WriteFile(filePath, []byte(fmt.Sprintf("test-%d", i)), 0644)
+		assert.Nil(t, err)
+	}
+
+	// Deduplicate using relative symlinks
+	s, err := storage.NewStorage(storage.StorageOptions{
+		Root:             storagePath,
+		LinkMode:         storage.LinkSymlink,
+		RelativeSymlinks: true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	// Migrate to a sharded layout, the symlinks follow the objects
+	moved, err := s.MigrateLayout(storage.Layout{Depth: 2, Width: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, testFiles, moved)
+
+	for path, fileHash := range p.FileMap {
+		info, err := os.Lstat(path)
+		assert.Nil(t, err)
+		assert.True(t, s.IsLinked(path, info, fileHash))
+
+		target, err := os.Readlink(path)
+		assert.Nil(t, err)
+		assert.False(t, filepath.IsAbs(target))
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	layout, err := storage.ParseLayout("2x3")
+	assert.Nil(t, err)
+	assert.Equal(t, storage.Layout{Depth: 2, Width: 3}, layout)
+	assert.Equal(t, "2x3", layout.String())
+
+	layout, err = storage.ParseLayout("flat")
+	assert.Nil(t, err)
+	assert.True(t, layout.IsFlat())
+
+	for _, invalid := range []string{"2", "2x", "2x2x2", "-1x2", "8x8"} {
+		_, err = storage.ParseLayout(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+
+	// A new storage is created with the given layout
+	storagePath := filepath.Join(t.TempDir(), "storage")
+	_, err = storage.NewStorage(storage.StorageOptions{Root: storagePath, Layout: storage.Layout{Depth: 1, Width: 2}})
+	assert.Nil(t, err)
+	s, err := storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.Layout{Depth: 1, Width: 2}, s.Opts.Layout)
+}
+
+func TestCheckSameDevice(t *testing.T) {
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	// Paths on the same filesystem, existing or not, are accepted
+	err = s.CheckSameDevice(filepath.Join(storagePath, "missing", "file"), "")
+	assert.Nil(t, err)
+
+	// /proc is always a different filesystem
+	err = s.CheckSameDevice("/proc/self")
+	assert.ErrorIs(t, err, storage.ErrCrossDevice)
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaterialize(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data, same content with different permissions
+	publicPath := filepath.Join(testPath, "public")
+	err = os.WriteFile(publicPath, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	privatePath := filepath.Join(testPath, "private")
+	err = os.WriteFile(privatePath, []byte("test"), 0600)
+	assert.Nil(t, err)
+
+	// Deduplicate
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	publicInfo, err := os.Lstat(publicPath)
+	assert.Nil(t, err)
+	privateInfo, err := os.Lstat(privatePath)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(publicInfo, privateInfo))
+
+	// Materialize, restoring the original metadata
+	report, err := s.Materialize(testPath, storage.MaterializeOptions{
+		Manifest: p.Manifest(),
+		GC:       true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Materialized))
+	assert.Equal(t, 1, len(report.Removed))
+
+	publicInfo, err = os.Lstat(publicPath)
+	assert.Nil(t, err)
+	privateInfo, err = os.Lstat(privatePath)
+	assert.Nil(t, err)
+	assert.False(t, os.SameFile(publicInfo, privateInfo))
+	assert.Equal(t, os.FileMode(0644), publicInfo.Mode().Perm())
+	assert.Equal(t, os.FileMode(0600), privateInfo.Mode().Perm())
+
+	content, err := os.ReadFile(privatePath)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", string(content))
+
+	// Nothing is left in the storage
+	files, err := s.ListFiles()
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	assert.Empty(t, s.Opts.Paths)
+}
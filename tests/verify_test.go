@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data
+	goodPath := filepath.Join(testPath, "good")
+	err = os.WriteFile(goodPath, []byte("good"), 0644)
+	assert.Nil(t, err)
+
+	badPath := filepath.Join(testPath, "bad")
+	err = os.WriteFile(badPath, []byte("bad"), 0644)
+	assert.Nil(t, err)
+
+	// Deduplicate
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	p := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	err = dabadee.NewDaBaDee(p, false).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Error during deduplication: %v", err)
+	}
+
+	report, err := s.Verify(h, storage.VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 2, report.Checked)
+
+	// Verifying with another hash than the one naming the objects fails
+	other, err := hash.NewGenerator("highwayhash")
+	assert.Nil(t, err)
+	report, err = s.Verify(other, storage.VerifyOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, report.Mismatches, 2)
+
+	// Corrupt an object through one of its links and add a stray file
+	err = os.WriteFile(badPath, []byte("flipped"), 0644)
+	assert.Nil(t, err)
+
+	err = os.WriteFile(filepath.Join(storagePath, "not-an-object"), []byte("stray"), 0644)
+	assert.Nil(t, err)
+
+	report, err = s.Verify(h, storage.VerifyOptions{Quarantine: true})
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 1, len(report.Mismatches))
+	assert.Equal(t, s.ObjectPath(p.FileMap[badPath]), report.Mismatches[0].Path)
+	assert.Equal(t, []string{filepath.Join(storagePath, "not-an-object")}, report.Stray)
+	assert.Equal(t, 1, len(report.Quarantined))
+
+	// The corrupted object is not in the storage anymore
+	_, err = os.Stat(s.ObjectPath(p.FileMap[badPath]))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(storagePath, ".quarantine", p.FileMap[badPath]))
+	assert.Nil(t, err)
+
+	// A mistyped storage path is not mistaken for an empty storage
+	missingPath := filepath.Join(t.TempDir(), "missing")
+	_, err = storage.OpenStorage(missingPath)
+	assert.True(t, errors.Is(err, storage.ErrNotStorage))
+	_, err = os.Stat(missingPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = storage.OpenStorage(storagePath)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkobrombin/dabadee/pkg/dabadee"
+	"github.com/mirkobrombin/dabadee/pkg/hash"
+	"github.com/mirkobrombin/dabadee/pkg/processor"
+	"github.com/mirkobrombin/dabadee/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	// Create temporary directories
+	testPath := filepath.Join(t.TempDir(), "testdata")
+	storagePath := filepath.Join(t.TempDir(), "storage")
+
+	err := os.MkdirAll(testPath, 0755)
+	assert.Nil(t, err)
+
+	// Create test data, already there when the watch starts
+	existingPath := filepath.Join(testPath, "existing")
+	err = os.WriteFile(existingPath, []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	s, err := storage.NewStorage(storage.StorageOptions{Root: storagePath})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+
+	h := hash.NewSHA256Generator()
+	dedup := processor.NewDedupProcessor(testPath, "", s, h, 1)
+	dedup.Exclude = []string{"*.tmp"}
+
+	processed := make(chan string, 10)
+	dedup.Subscribe(func(event processor.ProgressEvent) {
+		if event.Kind == processor.EventStored || event.Kind == processor.EventLinked {
+			processed <- event.Path
+		}
+	})
+
+	waitFor := func(path string) {
+		select {
+		case got := <-processed:
+			assert.Equal(t, path, got)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("File not processed: %s", path)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := processor.NewWatchProcessor(dedup, 50*time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- dabadee.NewDaBaDee(p, false).Run(ctx)
+	}()
+
+	// The existing file is processed by the initial scan
+	waitFor(existingPath)
+
+	// A duplicate written in a new directory is linked, the ignored file
+	// is left alone
+	err = os.WriteFile(filepath.Join(testPath, "ignored.tmp"), []byte("test"), 0644)
+	assert.Nil(t, err)
+
+	newDir := filepath.Join(testPath, "new")
+	err = os.MkdirAll(newDir, 0755)
+	assert.Nil(t, err)
+
+	// Give the watch a moment to pick up the new directory
+	time.Sleep(100 * time.Millisecond)
+	duplicatePath := filepath.Join(newDir, "duplicate")
+	err = os.WriteFile(duplicatePath, []byte("test"), 0644)
+	assert.Nil(t, err)
+	waitFor(duplicatePath)
+
+	existingInfo, err := os.Lstat(existingPath)
+	assert.Nil(t, err)
+	duplicateInfo, err := os.Lstat(duplicatePath)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(existingInfo, duplicateInfo))
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Empty(t, processed)
+	assert.Contains(t, p.Stats.Ignored, filepath.Join(testPath, "ignored.tmp"))
+
+	// The lock is not held between batches
+	lockFile, err := s.AcquireLock()
+	assert.Nil(t, err)
+	s.ReleaseLock(lockFile)
+}